@@ -2,4 +2,10 @@ module unfolder
 
 go 1.25.0
 
-require github.com/urfave/cli/v3 v3.4.1
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/urfave/cli/v3 v3.4.1
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -1,15 +1,44 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"io/fs"
+	"math"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
+	"time"
+	"unicode/utf8"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -18,6 +47,87 @@ const (
 
 	// EndMarker indicates the end of the repository content
 	EndMarker = "----END----"
+
+	// WatchDebounce is how long --watch waits for a burst of changes to settle
+	WatchDebounce = 300 * time.Millisecond
+
+	// BytesPerToken is the rough ratio used to estimate token counts
+	BytesPerToken = 4
+
+	// WrapMarker ends every line segment that --wrap broke off
+	WrapMarker = "↩"
+
+	// DefaultMaxRecursion is the default directory nesting limit guarding against
+	// pathological trees
+	DefaultMaxRecursion = 1000
+
+	// DefaultBufferSize is the default size of the output write buffer
+	DefaultBufferSize = 64 * 1024
+
+	// DefaultSniffBytes is how much of a file is checked for null bytes to detect binaries
+	DefaultSniffBytes = 512
+
+	// MinifiedLineLength is the average line length from which --exclude-minified takes
+	// a text file for minified; hand-written code stays far below it
+	MinifiedLineLength = 200
+
+	// MinifiedMinBytes is the size below which --exclude-minified never skips a file,
+	// so short one-liners are kept
+	MinifiedMinBytes = 1024
+
+	// DefaultReadRetries is how often a read failing with a transient error is retried
+	DefaultReadRetries = 2
+
+	// ReadRetryDelay is the wait before the first retry; it doubles with every attempt
+	ReadRetryDelay = 100 * time.Millisecond
+
+	// TimeoutExitCode is the exit status when --timeout stops a run, as with timeout(1)
+	TimeoutExitCode = 124
+
+	// InterruptExitCode is the exit status after Ctrl-C, as shells report for SIGINT
+	InterruptExitCode = 130
+
+	// GroupBanner surrounds the directory name that starts a --group-by-dir group
+	GroupBanner = "===="
+
+	// AnnotationPrefix and AnnotationSuffix surround --annotate-truncation markers
+	AnnotationPrefix = "[unfolder: "
+	AnnotationSuffix = "]"
+
+	// Base64Notice is the first body line of a text section holding a base64-encoded binary
+	Base64Notice = "(base64)"
+
+	// Base64LineLength is the line length of base64-encoded content, as in MIME
+	Base64LineLength = 76
+
+	// NoNewlineNotice follows the content of a file without a final newline when the
+	// text format is written with --trailing-newline=false, as in diff output
+	NoNewlineNotice = "\\ No newline at end of file"
+
+	// RemovedNotice is the body of a --diff-against section for a file that no longer exists
+	RemovedNotice = "(removed)"
+
+	// JSONFileSuffix is appended to a file's name in a --preserve-structure tree when
+	// a directory has the same name
+	JSONFileSuffix = "~file"
+
+	// EmptyDirNotice is the body of an --emit-empty-dirs section
+	EmptyDirNotice = "(empty)"
+
+	// SymlinkNotice starts the body of a --note-symlinks section, followed by the target and ")"
+	SymlinkNotice = "(symlink to "
+
+	// JSONSymlinkKey holds the target of a skipped symlink in a --preserve-structure tree
+	JSONSymlinkKey = "~symlink"
+
+	// DefaultOutputTemplate reproduces the historical <basename>.txt output name
+	DefaultOutputTemplate = "{{.Base}}.{{.Ext}}"
+
+	// DefaultFileTemplate reproduces the historical text format file section
+	DefaultFileTemplate = "{{.Divider}}\n{{.Path}}\n{{.Content}}"
+
+	// UTF8BOM starts the output with --output-encoding=utf8-bom
+	UTF8BOM = "\ufeff"
 )
 
 // VCS directories to auto-exclude by default
@@ -30,8 +140,18 @@ var vcsDirectories = []string{
 	".darcs/",
 }
 
-// Global warning counter
-var warningCount int
+// Warnings printed during the current run
+var warnings []string
+
+// ANSI colors for stderr messages
+const (
+	colorRed    = "\033[31m"
+	colorYellow = "\033[33m"
+	colorReset  = "\033[0m"
+)
+
+// Whether stderr messages are colorized (disabled by --no-color)
+var useColor = stderrSupportsColor()
 
 // Version information (set by build process)
 var (
@@ -42,711 +162,6570 @@ var (
 
 var header = fmt.Sprintf(`This text describes a repository with code. It consists of sections starting with %s, followed by a line with the file path and name, then varying lines of file contents. The repository text concludes when %s is reached. Any text after %s is to be understood as instructions related to the provided repository.`, SectionDivider, EndMarker, EndMarker)
 
+// headerWithoutEndMarker describes the text format written with --no-end-marker
+var headerWithoutEndMarker = fmt.Sprintf(`This text describes a repository with code. It consists of sections starting with %s, followed by a line with the file path and name, then varying lines of file contents. The last section runs to the end of the text.`, SectionDivider)
+
+var htmlHeader = `This page describes a repository with code. Each section holds one file, headed by its path. Use the sidebar to jump to a file.`
+
+var ndjsonHeader = `This stream describes a repository with code. Each line is a JSON object; file objects carry the file path and name in "path" and the file contents in "content". The stream concludes with an object holding "stats".`
+
+var jsonHeader = `This document describes a repository with code. The files array holds one object per file, with the file path and name in "path" and the file contents in "content".`
+
+var jsonTreeHeader = `This document describes a repository with code. The tree object mirrors the directory structure: directories are objects keyed by name, and each file is a string holding its contents.`
+
+var yamlHeader = `This document describes a repository with code. The files list holds one entry per file, with the file path and name in "path" and the file contents in "content".`
+
+var xmlHeader = `This document describes a repository with code. Each file element carries the file path and name in its path attribute and the file contents as character data. The repository concludes with the closing repository tag.`
+
+// Lockfiles and similar generated files skipped by default
+var lockfiles = []string{
+	"package-lock.json",
+	"npm-shrinkwrap.json",
+	"yarn.lock",
+	"pnpm-lock.yaml",
+	"bun.lockb",
+	"go.sum",
+	"Cargo.lock",
+	"Gemfile.lock",
+	"composer.lock",
+	"poetry.lock",
+	"Pipfile.lock",
+	"uv.lock",
+	"pubspec.lock",
+	"Podfile.lock",
+	"mix.lock",
+	"flake.lock",
+}
+
+// Patterns for test files and directories skipped with --exclude-test-files
+var testFilePatterns = []string{
+	"*_test.go",
+	"test_*.py",
+	"*_test.py",
+	"*.test.js",
+	"*.spec.js",
+	"*.test.jsx",
+	"*.spec.jsx",
+	"*.test.ts",
+	"*.spec.ts",
+	"*.test.tsx",
+	"*.spec.tsx",
+	"**/__tests__/",
+}
+
+// Patterns for vendored and third-party code skipped with --exclude-vendored,
+// adapted from the vendor list of GitHub's linguist
+var vendoredPatterns = []string{
+	// Dependency and third-party directories
+	"**/vendor/",
+	"**/vendors/",
+	"**/node_modules/",
+	"**/bower_components/",
+	"**/jspm_packages/",
+	"**/Godeps/",
+	"**/Pods/",
+	"**/Carthage/",
+	"**/third_party/",
+	"**/third-party/",
+	"**/thirdparty/",
+	"**/3rdparty/",
+	"**/3rd_party/",
+	"**/extern/",
+	"**/external/",
+	"**/externals/",
+	"**/deps/",
+	"**/.yarn/releases/",
+	"**/.yarn/plugins/",
+	"**/.yarn/sdks/",
+	"**/.yarn/versions/",
+	"**/.yarn/unplugged/",
+	"/debian/",
+	// Build tool wrappers
+	"gradlew",
+	"gradlew.bat",
+	"**/gradle/wrapper/",
+	"mvnw",
+	"mvnw.cmd",
+	"**/.mvn/wrapper/",
+	// Autotools helpers
+	"config.guess",
+	"config.sub",
+	"aclocal.m4",
+	"ltmain.sh",
+	// Minified and bundled web libraries
+	"*.min.js",
+	"*-min.js",
+	"*.min.css",
+	"*-min.css",
+	"jquery*.js",
+	"bootstrap*.js",
+	"bootstrap*.css",
+	"**/font-awesome/",
+	"**/fontawesome/",
+	"modernizr*.js",
+	"underscore*.js",
+	"backbone*.js",
+	"angular*.js",
+	"d3*.js",
+}
+
 // IgnorePattern represents a single ignore pattern with its directory context
 type IgnorePattern struct {
 	Pattern   string // The actual pattern (e.g., "*.log", "temp/")
 	Dir       string // The directory where this pattern was found (relative to root)
 	IsNegated bool   // Whether this pattern is negated (starts with !)
+	Source    string // The ignore file the pattern was read from
+	Line      int    // Line number within Source
+}
+
+// String describes the pattern and where it came from
+func (p IgnorePattern) String() string {
+	pattern := p.Pattern
+	if p.IsNegated {
+		pattern = "!" + pattern
+	}
+	if p.Source == "" {
+		return fmt.Sprintf("pattern %q", pattern)
+	}
+	if p.Line == 0 {
+		return fmt.Sprintf("pattern %q from %s", pattern, p.Source)
+	}
+	return fmt.Sprintf("pattern %q from %s:%d", pattern, p.Source, p.Line)
+}
+
+// FileEntry is a file selected for output
+type FileEntry struct {
+	Path       string          // Absolute path on disk
+	RelPath    string          // Path relative to the scanned directory
+	Size       int64           // Content size in bytes (filled in for --manifest)
+	Lines      int             // Number of lines (filled in for --manifest)
+	Info       fs.FileInfo     // File information from the walk, for --sort
+	Attributes map[string]bool // Attributes set by .unfolderattributes
+	Binary     bool            // Written base64-encoded, with --exclude-binary=false
+	Root       string          // Resolved input directory the file was found in
+	LinkTarget string          // Target of a skipped symlink, as stored in the link
+
+	content  []byte // Content read by measureFiles, written without reading the file again
+	measured bool   // Whether content holds the file's content
+}
+
+// AttributeRule assigns attributes to the files matching one line of a .unfolderattributes file
+type AttributeRule struct {
+	Pattern    IgnorePattern   // The path pattern and where it was defined
+	Attributes map[string]bool // Attribute name to set (true) or unset (false)
 }
 
+// Attributes understood in .unfolderattributes
+const (
+	AttrPriority      = "priority"       // Emit the file before all others except --priority matches
+	AttrNeverTruncate = "never-truncate" // Keep the whole file despite --max-file-size
+)
+
 // Config holds the program configuration
 type Config struct {
 	Directory             string
 	Output                string
 	OutputPath            string
+	OutputTemplate        string
+	Format                string
+	Formatter             Formatter
+	ExtraOutputs          []ExtraOutput // Additional formats written by the same run (--also-format)
 	IncludeVCSDirectories bool
+	DeepNegation          bool
+	GitParity             bool
+	GitChecker            *gitIgnoreChecker
+	Priority              []string
+	Dedup                 bool
+	Manifest              bool
+	IgnorePaths           []string
+	NoClobber             bool
+	Watch                 bool
+	StripTrailingSpace    bool
+	CollapseBlankLines    bool
+	Verbose               bool
+	MaxDepth              int
+	ExcludeExts           map[string]bool
+	ExtIgnoreCase         bool // Match OnlyExts and ExcludeExts case-insensitively
+	Index                 bool
+	CountOnly             bool
+	Wrap                  int
+	Include               []string
+	Exclude               []string
+	PatternsRelative      string
+	IgnoreCase            bool // Match ignore, --include, --exclude and --priority patterns case-insensitively
+	Highlight             bool
+	RootIgnoreOnly        bool
+	Stats                 bool
+	Top                   int
+	SummaryJSON           string
+	BufferSize            int
+	MaxRecursion          int
+	OnlyExts              map[string]bool
+	NativeSeparators      bool
+	StdinList             bool
+	NullSeparated         bool
+	ListedFiles           map[string]bool
+	MaxFileSize           int64
+	MaxTotalSize          int64
+	TruncateLarge         int
+	DiffAgainst           string
+	AppendTo              string
+	PreviousFiles         map[string][]byte
+	IncludeLockfiles      bool
+	NoDefaultExcludes     bool
+	ExcludeTestFiles      bool
+	ExcludeVendored       bool
+	ExcludeMinified       bool
+	ExcludeDirs           []string
+	NoHidden              bool
+	GroupByDir            bool
+	AbsolutePaths         bool
+	Strict                bool
+	Sort                  string
+	Attributes            []AttributeRule
+	OnError               string
+	OutputEncoding        string
+	RelativeTo            string
+	BinarySniffBytes      int // 0 means DefaultSniffBytes, -1 means the whole file
+	Interactive           bool
+	ContentInput          io.Reader // Read files from a content manifest instead of Directory
+	ReadRetries           int
+	IncludeBinary         bool
+	MergeDirs             []string
+	MaxTokens             int
+	MaxFiles              int
+	AnnotateTruncation    bool
+	Transformers          []Transformer // Applied in order to the content of every text file
+	FileTemplate          string        // Layout of a text format file section; "" means DefaultFileTemplate
+	EmitEmptyDirs         bool
+	NoteSymlinks          bool
+	PreserveStructure     bool
+	JSONCompact           bool
+	NoEndMarker           bool
+	NoTrailingNewline     bool
+	SectionSpacing        int
+	WalkedDirs            []FileEntry     // Directories entered by the walk, for --emit-empty-dirs
+	Symlinks              []FileEntry     // Symlinks skipped by the walk, for --note-symlinks
+	Context               context.Context // Stops the run early when done; nil never stops
+	NoHeader              bool
+	Header                string
+}
+
+// writeState tracks what has been written during the write phase
+type writeState struct {
+	seen  map[[sha256.Size]byte]string // Content hash to first relative path, for --dedup
+	index []IndexEntry                 // Location of every written file, for --index
+	group string                       // --group-by-dir banner to write before the next section
+	stats *Stats
+
+	outputBytes int64    // Bytes the output will take so far, counted against --max-total-size
+	full        bool     // Set once a file didn't fit in --max-total-size
+	dropped     []string // Files left out to stay within --max-total-size
+	capped      int      // Files left out once --max-files sections were written
+}
+
+// Stats summarizes the files written during a run
+type Stats struct {
+	Files       int                        `json:"files"`        // Number of files written
+	Bytes       int64                      `json:"bytes"`        // Content bytes written
+	ByExtension map[string]*ExtensionStats `json:"by_extension"` // Per-extension breakdown, keyed by filepath.Ext
+	ByFile      map[string]int64           `json:"-"`            // Content bytes written per file
+	Skipped     map[SkipReason]int         `json:"skipped"`      // Files left out, by reason
+	OutputBytes int64                      `json:"output_bytes"` // Size of the output, including headers and markers
+	Tokens      int64                      `json:"tokens"`       // Estimated tokens of the output
+	Warnings    []string                   `json:"warnings"`     // Warnings printed during the run
+}
+
+// SkipReason classifies why a file was left out of the output
+type SkipReason string
+
+const (
+	SkipIgnored    SkipReason = "ignored"    // Matched an ignore rule or was not selected by a filter
+	SkipBinary     SkipReason = "binary"     // Detected as binary
+	SkipOversized  SkipReason = "oversized"  // Larger than --max-file-size
+	SkipPermission SkipReason = "permission" // Could not be read
+	SkipError      SkipReason = "error"      // Failed to read with --on-error=skip
+	SkipBudget     SkipReason = "budget"     // Left out to stay within --max-tokens
+	SkipTotalSize  SkipReason = "total_size" // Left out to stay within --max-total-size
+	SkipMaxFiles   SkipReason = "max_files"  // Left out once --max-files files were written
+	SkipMinified   SkipReason = "minified"   // Detected as minified with --exclude-minified
+)
+
+// ExtensionStats counts the files and content bytes written for one extension
+type ExtensionStats struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// newStats returns empty statistics
+func newStats() *Stats {
+	return &Stats{ByExtension: make(map[string]*ExtensionStats), ByFile: make(map[string]int64), Skipped: make(map[SkipReason]int), Warnings: []string{}}
+}
+
+// totalSkipped returns the number of files left out for any reason
+func (s *Stats) totalSkipped() int {
+	total := 0
+	for _, count := range s.Skipped {
+		total += count
+	}
+	return total
+}
+
+// skip records one file left out of the output
+func (s *Stats) skip(reason SkipReason) {
+	s.Skipped[reason]++
+}
+
+// add records one written file
+func (s *Stats) add(relPath string, bytes int64) {
+	s.Files++
+	s.Bytes += bytes
+	s.ByFile[relPath] = bytes
+
+	ext := filepath.Ext(relPath)
+	if s.ByExtension[ext] == nil {
+		s.ByExtension[ext] = &ExtensionStats{}
+	}
+	s.ByExtension[ext].Files++
+	s.ByExtension[ext].Bytes += bytes
+}
+
+// IndexEntry locates one file section within the output, for --index
+type IndexEntry struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"` // Byte offset of the section within the output
+	Length int64  `json:"length"` // Byte length of the section, including divider and path line
+	SHA256 string `json:"sha256"` // Hash of the file content as written
+}
+
+// OutputNameData holds the variables available to --output-template
+type OutputNameData struct {
+	Base string // Base name of the target directory
+	Date string // Current date (YYYY-MM-DD)
+	Time string // Current time (HHMMSS)
+	Ext  string // Extension of the chosen output format, without the dot
+}
+
+// FileData holds the variables available to --file-template
+type FileData struct {
+	Divider  string // Line starting each file section
+	Path     string // Path of the file as written
+	Content  string // File content, ending with a newline unless empty
+	Size     int64  // Content size in bytes
+	Hash     string // SHA-256 of the content, hex encoded
+	Language string // Language name from detectLanguage, or ""
+}
+
+// HeaderData holds the variables available to --header-file
+type HeaderData struct {
+	Divider   string // Line starting each file section
+	EndMarker string // Line ending the repository contents
+}
+
+// stderrSupportsColor reports whether stderr is a terminal that should get colors
+func stderrSupportsColor() bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorize wraps text in the given color when colors are enabled
+func colorize(color, text string) string {
+	if !useColor {
+		return text
+	}
+	return color + text + colorReset
+}
+
+// envVar returns the UNFOLDER_* environment variable that provides a default for
+// the flag (e.g. --exclude-dir is read from UNFOLDER_EXCLUDE_DIR)
+func envVar(flag string) cli.ValueSourceChain {
+	return cli.EnvVars("UNFOLDER_" + strings.ToUpper(strings.ReplaceAll(flag, "-", "_")))
 }
 
 // exitWithError prints an error message and exits with code 1
 func exitWithError(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, "Error: "+format+"\n", args...)
-	os.Exit(1)
+	exitWithCode(1, format, args...)
+}
+
+// exitWithCode prints an error message and exits with the given code
+func exitWithCode(code int, format string, args ...interface{}) {
+	fmt.Fprintln(os.Stderr, colorize(colorRed, "Error: "+fmt.Sprintf(format, args...)))
+	os.Exit(code)
 }
 
-// printWarning prints a warning message and increments the warning counter
+// printVerbose prints a diagnostic message when --verbose is set
+func printVerbose(config *Config, format string, args ...interface{}) {
+	if config.Verbose {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
+// printWarning prints a warning message and records it for the run's Stats
 func printWarning(format string, args ...interface{}) {
-	warningCount++
-	fmt.Fprintf(os.Stderr, "Warning: "+format+"\n", args...)
+	message := fmt.Sprintf(format, args...)
+	warnings = append(warnings, message)
+	fmt.Fprintln(os.Stderr, colorize(colorYellow, "Warning: "+message))
 }
 
-func main() {
-	cmd := &cli.Command{
+// newCommand builds the command line: the root command, its flags and verify
+func newCommand() *cli.Command {
+	return &cli.Command{
 		Name:    "unfolder",
 		Usage:   "Convert repository contents to text format for AI analysis",
 		Version: fmt.Sprintf("%s (%s) %s", version, commit, date),
+		// Adds the hidden `completion bash|zsh|fish|pwsh` command
+		EnableShellCompletion: true,
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "chdir",
+				Usage:   "Run as if started in `DIR`, like git -C: relative paths in arguments and flags resolve against it",
+				Aliases: []string{"C"},
+			},
 			&cli.BoolFlag{
 				Name:    "include-vcs",
 				Usage:   "Include VCS directories (.git/, .svn/, etc.) in output",
 				Aliases: []string{"vcs"},
+				Sources: envVar("include-vcs"),
+			},
+			&cli.BoolFlag{
+				Name:  "no-color",
+				Usage: "Disable colored warnings and errors",
+			},
+			&cli.BoolFlag{
+				Name:  "verbose",
+				Usage: "Explain why files and directories are skipped",
+			},
+			&cli.BoolFlag{
+				Name:    "git-parity",
+				Usage:   "Let git decide which files are ignored (falls back to the built-in matcher outside git repositories)",
+				Sources: envVar("git-parity"),
+			},
+			&cli.StringFlag{
+				Name:  "git-ref",
+				Usage: "Read files (and ignore files) as committed at this git ref instead of the working tree",
+			},
+			&cli.IntFlag{
+				Name:  "max-recursion",
+				Usage: "Safety limit on directory nesting; deeper directories are skipped with a warning",
+				Value: DefaultMaxRecursion,
+			},
+			&cli.BoolFlag{
+				Name:  "root-ignore-only",
+				Usage: "Only read .gitignore and .unfolderignore in the root directory",
+			},
+			&cli.IntFlag{
+				Name:    "max-depth",
+				Usage:   "Only descend `N` directory levels below the root (0 = root files only, -1 = unlimited)",
+				Value:   -1,
+				Sources: envVar("max-depth"),
+			},
+			&cli.BoolFlag{
+				Name:  "stdin",
+				Usage: "Read file paths and contents from a manifest on stdin instead of a directory",
+			},
+			&cli.BoolFlag{
+				Name:  "stdin-list",
+				Usage: "Only consider the files listed on stdin (one path per line, relative to the directory)",
+			},
+			&cli.BoolFlag{
+				Name:  "only-changed-git",
+				Usage: "Only consider files that git status reports as modified, added, renamed or untracked",
+			},
+			&cli.BoolFlag{
+				Name:  "null",
+				Usage: "Paths on stdin and in the text manifest are NUL-separated, like find -print0",
+			},
+			&cli.StringSliceFlag{
+				Name:    "include",
+				Usage:   "Only include files matching gitignore-style `PATTERN` (repeatable)",
+				Sources: envVar("include"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "exclude",
+				Usage:   "Exclude files matching gitignore-style `PATTERN` (repeatable)",
+				Sources: envVar("exclude"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "exclude-dir",
+				Usage:   "Skip directories named `NAME` at any depth (repeatable)",
+				Sources: envVar("exclude-dir"),
+			},
+			&cli.BoolFlag{
+				Name:    "no-hidden",
+				Usage:   "Skip files and directories whose name starts with a dot, unless an --include pattern names them",
+				Sources: envVar("no-hidden"),
+			},
+			&cli.StringFlag{
+				Name:  "patterns-relative",
+				Usage: "Anchor --include/--exclude patterns containing a slash to the scanned `root` or the current directory (`cwd`)",
+				Value: "root",
+			},
+			&cli.StringSliceFlag{
+				Name:    "only-ext",
+				Usage:   "Only include files with these comma-separated `EXTENSIONS` (e.g. .go)",
+				Sources: envVar("only-ext"),
+			},
+			&cli.BoolFlag{
+				Name:  "ext-ignore-case",
+				Usage: "Match --only-ext and --exclude-ext case-insensitively on every platform",
+			},
+			&cli.BoolFlag{
+				Name:  "ignore-case",
+				Usage: "Match ignore, --include and --exclude patterns case-insensitively",
+			},
+			&cli.StringSliceFlag{
+				Name:    "exclude-ext",
+				Usage:   "Skip files with these comma-separated `EXTENSIONS` (e.g. .md,.txt)",
+				Sources: envVar("exclude-ext"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "ignore-path",
+				Aliases: []string{"exclude-from"},
+				Usage:   "Load additional ignore patterns from `FILE` as if it were at the root (repeatable)",
+				Sources: envVar("ignore-path"),
+			},
+			&cli.BoolFlag{
+				Name:    "deep-negation",
+				Usage:   "Let negations such as !vendor/mypkg/** re-include files below an ignored directory, unlike git",
+				Sources: envVar("deep-negation"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "priority",
+				Usage:   "Emit files matching `GLOB` first (repeatable, earlier globs win)",
+				Sources: envVar("priority"),
+			},
+			&cli.StringFlag{
+				Name:    "sort",
+				Usage:   "Order files by `KEY`: name, size (largest first) or mtime (newest first)",
+				Value:   "name",
+				Sources: envVar("sort"),
+			},
+			&cli.StringFlag{
+				Name:    "max-file-size",
+				Usage:   "Skip files larger than `SIZE` (e.g. 500KB, 2MB; 0 = no limit)",
+				Sources: envVar("max-file-size"),
+			},
+			&cli.StringFlag{
+				Name:    "max-total-size",
+				Usage:   "Stop including files once the output would grow past `SIZE` (e.g. 20MB); files written first are kept",
+				Sources: envVar("max-total-size"),
+			},
+			&cli.IntFlag{
+				Name:  "max-tokens",
+				Usage: "Keep the output within about `N` tokens, preferring priority files, then smaller files",
+			},
+			&cli.IntFlag{
+				Name:  "max-files",
+				Usage: "Stop including files once `N` have been written; files written first are kept",
+			},
+			&cli.BoolFlag{
+				Name:  "annotate-truncation",
+				Usage: "Mark content that isn't verbatim with a machine-readable [unfolder: ...] line",
+			},
+			&cli.IntFlag{
+				Name:  "truncate-large",
+				Usage: "Instead of skipping files over --max-file-size, include their first `N` lines",
+			},
+			&cli.StringFlag{
+				Name:  "diff-against",
+				Usage: "Only emit files that changed since the previous text output `FILE`, and list removed files",
+			},
+			&cli.StringFlag{
+				Name:  "append-to",
+				Usage: "Append the files that are new or changed since the text output `FILE` was written to FILE itself",
+			},
+			&cli.BoolFlag{
+				Name:  "preserve-structure",
+				Usage: "With --format json, write a nested directory tree instead of a flat files array",
+			},
+			&cli.BoolFlag{
+				Name:  "json-compact",
+				Usage: "With --format json, write the document on a single line instead of indenting it",
+			},
+			&cli.BoolFlag{
+				Name:  "trailing-newline",
+				Usage: "Add a newline to text format content that lacks one; with =false a \"" + NoNewlineNotice + "\" line marks such files instead, so they can be restored exactly",
+				Value: true,
+			},
+			&cli.IntFlag{
+				Name:  "section-spacing",
+				Usage: "Write `N` blank lines before each section of the text format; pass the same N to verify, --diff-against and --append-to when reading the output back",
+			},
+			&cli.BoolFlag{
+				Name:  "no-end-marker",
+				Usage: "Don't write the " + EndMarker + " line after the last file of the text format",
+			},
+			&cli.BoolFlag{
+				Name:  "emit-empty-dirs",
+				Usage: "Add a section for every directory without included files",
+			},
+			&cli.BoolFlag{
+				Name:    "note-symlinks",
+				Aliases: []string{"relative-symlinks"},
+				Usage:   "Add a section with the target of every skipped symlink (symlinked directories and broken links)",
+			},
+			&cli.BoolFlag{
+				Name:  "group-by-dir",
+				Usage: "Emit files grouped by top-level directory, with a banner before each group",
+			},
+			&cli.BoolFlag{
+				Name:  "strict",
+				Usage: "Fail instead of warning when a file contains a line equal to the section divider or end marker, when --on-error=skip skipped files, or when no file was included",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "Stop after `DURATION` (e.g. 30s), ending the output after the files written so far (0 = no limit)",
+			},
+			&cli.IntFlag{
+				Name:  "read-retries",
+				Usage: "Retry reads failing with transient errors such as EIO up to `N` times, with backoff",
+				Value: DefaultReadRetries,
+			},
+			&cli.StringFlag{
+				Name:  "on-error",
+				Usage: "What to do when a file or directory can't be read: `abort` the run or skip it with a warning",
+				Value: "abort",
+			},
+			&cli.StringFlag{
+				Name:    "output-encoding",
+				Usage:   "Encoding of the output file: `utf8`, or utf8-bom to start it with a byte order mark",
+				Value:   "utf8",
+				Sources: envVar("output-encoding"),
+			},
+			&cli.BoolFlag{
+				Name:  "dedup",
+				Usage: "Emit identical files once and reference the first copy for duplicates",
+			},
+			&cli.BoolFlag{
+				Name:  "manifest",
+				Usage: "List every included file with its line count and size after the header",
+			},
+			&cli.BoolFlag{
+				Name:  "index",
+				Usage: "Also write <name>.index.json with the byte offset, length and hash of every file",
+			},
+			&cli.BoolFlag{
+				Name:  "stats",
+				Usage: "Show a per-extension breakdown of files and bytes in the summary",
+			},
+			&cli.IntFlag{
+				Name:  "top",
+				Usage: "List the `N` largest included files in the summary",
+			},
+			&cli.StringFlag{
+				Name:  "summary-json",
+				Usage: "Also write the run summary as JSON to `FILE` (- for stdout)",
+			},
+			&cli.StringFlag{
+				Name:  "lang-map",
+				Usage: "Add or override extension to language mappings from `FILE` (lines of \".ext language\")",
+			},
+			&cli.StringSliceFlag{
+				Name:  "comment-style",
+				Usage: "Teach the minify transformer the line comment prefixes of an extension, e.g. `.ext://,--`; repeatable",
+			},
+			&cli.BoolFlag{
+				Name:  "list-languages",
+				Usage: "Print the extension to language table used for code hints and exit",
+			},
+			&cli.BoolFlag{
+				Name:  "count-only",
+				Usage: "Only report the number of files, bytes and estimated tokens; write nothing",
+			},
+			&cli.BoolFlag{
+				Name:  "interactive",
+				Usage: "Choose which of the selected files to write from a numbered list before writing",
+			},
+			&cli.BoolFlag{
+				Name:  "watch",
+				Usage: "Keep running and regenerate the output whenever a file changes",
+			},
+			&cli.BoolFlag{
+				Name:  "strip-trailing-whitespace",
+				Usage: "Remove trailing spaces and tabs from every line",
+			},
+			&cli.BoolFlag{
+				Name:  "collapse-blank-lines",
+				Usage: "Replace every run of three or more blank lines with a single blank line",
+			},
+			&cli.StringSliceFlag{
+				Name:  "transform",
+				Usage: "Run file contents through a built-in transformer (" + strings.Join(transformerNames, ", ") + "); repeatable, applied in order",
+			},
+			&cli.IntFlag{
+				Name:  "wrap",
+				Usage: "Soft-wrap lines longer than `N` columns, marking each break with " + WrapMarker + " (lossy, 0 = off)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "also-format",
+				Usage: "Also write the output in `FORMAT`, to the output path with that format's extension (repeatable); files are selected and read once",
+			},
+			&cli.StringFlag{
+				Name:    "format",
+				Usage:   "Output format (text, xml, html, json, ndjson, yaml, tar, tar.gz); defaults to the one matching the output file's extension",
+				Value:   "text",
+				Sources: envVar("format"),
+			},
+			&cli.BoolFlag{
+				Name:    "include-lockfiles",
+				Usage:   "Include lockfiles such as package-lock.json and go.sum, which are skipped by default",
+				Sources: envVar("include-lockfiles"),
+			},
+			&cli.BoolFlag{
+				Name:    "no-default-excludes",
+				Usage:   "Don't apply the built-in exclude patterns (currently the lockfile list); ignore files and VCS settings still apply",
+				Sources: envVar("no-default-excludes"),
+			},
+			&cli.BoolFlag{
+				Name:    "exclude-test-files",
+				Usage:   "Skip common test files and directories (*_test.go, test_*.py, *.spec.ts, __tests__/, ...)",
+				Sources: envVar("exclude-test-files"),
+			},
+			&cli.BoolFlag{
+				Name:    "exclude-vendored",
+				Usage:   "Skip vendored and third-party code, using patterns adapted from GitHub's linguist (vendor/, node_modules/, bower_components/, jquery*.js, ...)",
+				Sources: envVar("exclude-vendored"),
+			},
+			&cli.BoolFlag{
+				Name:    "exclude-minified",
+				Usage:   "Skip text files that look minified, judged by their average line length",
+				Sources: envVar("exclude-minified"),
+			},
+			&cli.BoolFlag{
+				Name:    "no-header",
+				Usage:   "Don't write the description at the top of the output",
+				Sources: envVar("no-header"),
+			},
+			&cli.StringFlag{
+				Name:    "header-file",
+				Usage:   "Use the text in `FILE` as the description at the top of the output",
+				Sources: envVar("header-file"),
+			},
+			&cli.BoolFlag{
+				Name:  "no-clobber",
+				Usage: "Never overwrite an existing output file; add a numeric suffix instead",
+			},
+			&cli.BoolFlag{
+				Name:  "highlight",
+				Usage: "Load highlight.js from a CDN for syntax highlighting in HTML output",
+			},
+			&cli.IntFlag{
+				Name:  "buffer-size",
+				Usage: "Size of the output write buffer in `BYTES`",
+				Value: DefaultBufferSize,
+			},
+			&cli.BoolFlag{
+				Name:  "exclude-binary",
+				Usage: "Skip binary files; with --exclude-binary=false they are written base64-encoded instead",
+				Value: true,
+			},
+			&cli.IntFlag{
+				Name:  "binary-sniff-bytes",
+				Usage: "Check the first `N` bytes of each file for null bytes to detect binaries (-1 checks the whole file)",
+				Value: DefaultSniffBytes,
+			},
+			&cli.StringSliceFlag{
+				Name:  "merge",
+				Usage: "Also write the files of `DIR`, after those of the main directory (repeatable)",
+			},
+			&cli.StringFlag{
+				Name:  "relative-to",
+				Usage: "Write paths relative to `DIR`, which must contain the scanned directory",
+			},
+			&cli.BoolFlag{
+				Name:  "absolute-paths",
+				Usage: "Write absolute paths instead of paths relative to the directory",
+			},
+			&cli.BoolFlag{
+				Name:  "native-separators",
+				Usage: "Write paths with the OS path separator instead of forward slashes",
+			},
+			&cli.StringFlag{
+				Name:   "cpuprofile",
+				Usage:  "Write a CPU profile to `FILE`",
+				Hidden: true,
+			},
+			&cli.StringFlag{
+				Name:   "memprofile",
+				Usage:  "Write a heap profile to `FILE`",
+				Hidden: true,
+			},
+			&cli.StringFlag{
+				Name:  "file-template",
+				Usage: "Template for each file section of the text format (variables: .Divider, .Path, .Content, .Size, .Hash, .Language)",
+			},
+			&cli.StringFlag{
+				Name:    "output-template",
+				Usage:   "Template for the default output filename (variables: .Base, .Date, .Time, .Ext)",
+				Value:   DefaultOutputTemplate,
+				Sources: envVar("output-template"),
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "verify",
+				Usage:     "Report the files of a text output that changed or disappeared since it was written",
+				ArgsUsage: "OUTPUT [DIRECTORY]",
+				Action:    verify,
 			},
 		},
+		// -C applies before any command, so verify resolves its paths the same way
+		Before: changeDirectory,
 		Action: run,
+		// Report errors from run ourselves so they get the same styling as warnings
+		ExitErrHandler: func(ctx context.Context, cmd *cli.Command, err error) {
+			if exitErr, ok := err.(cli.ExitCoder); ok {
+				exitWithCode(exitErr.ExitCode(), "%v", err)
+			}
+		},
 	}
+}
+
+func main() {
+	cmd := newCommand()
+
+	// Ctrl-C cancels the context so a run can end its output cleanly. A second
+	// Ctrl-C is no longer caught and stops the program at once.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	if err := cmd.Run(context.Background(), os.Args); err != nil {
+	if err := cmd.Run(ctx, os.Args); err != nil {
 		exitWithError("%v", err)
 	}
 }
 
-// run is the main application logic
-func run(ctx context.Context, c *cli.Command) error {
-	args := c.Args().Slice()
+// changeDirectory handles -C by switching the working directory before anything
+// else runs, so every relative path, including the default output, resolves against it
+func changeDirectory(ctx context.Context, c *cli.Command) (context.Context, error) {
+	dir := c.String("chdir")
+	if dir == "" {
+		return ctx, nil
+	}
+	if err := os.Chdir(dir); err != nil {
+		return ctx, cli.Exit(fmt.Sprintf("Cannot change directory: %v", err), 1)
+	}
+	return ctx, nil
+}
 
-	// Parse positional arguments
-	var directory, output string
-	switch len(args) {
-	case 0:
+// verify checks the files of a text output against the directory they were read
+// from, printing the ones that changed or are missing. It fails if there are any.
+func verify(ctx context.Context, c *cli.Command) error {
+	if c.NArg() < 1 || c.NArg() > 2 {
+		return cli.Exit("Expected a text output file and optionally the directory it was written from", 1)
+	}
+	bundlePath, directory := c.Args().Get(0), c.Args().Get(1)
+	if directory == "" {
 		directory = "."
-	case 1:
-		directory = args[0]
-	case 2:
-		directory = args[0]
-		output = args[1]
-	default:
-		return cli.Exit("Too many arguments", 1)
 	}
 
-	// Create config
-	config := &Config{
-		Directory:             directory,
-		Output:                output,
-		IncludeVCSDirectories: c.Bool("include-vcs"),
+	files, err := readBundleFile(bundlePath, c.Int("section-spacing"))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Could not read %s: %v", bundlePath, err), 1)
+	}
+
+	paths := make([]string, 0, len(files))
+	for relPath := range files {
+		paths = append(paths, relPath)
+	}
+	sort.Strings(paths)
+
+	differences := 0
+	for _, relPath := range paths {
+		path := relPath
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(directory, filepath.FromSlash(relPath))
+		}
+		content, err := os.ReadFile(path)
+		switch {
+		case os.IsNotExist(err):
+			fmt.Printf("missing  %s\n", relPath)
+		case err != nil:
+			fmt.Printf("error    %s: %v\n", relPath, err)
+		case sameBundledContent(files[relPath], content):
+			continue
+		default:
+			fmt.Printf("changed  %s\n", relPath)
+		}
+		differences++
+	}
+
+	if differences > 0 {
+		return cli.Exit(fmt.Sprintf("%d of %d file(s) in %s changed or are missing", differences, len(paths), bundlePath), 1)
+	}
+	fmt.Printf("All %d file(s) in %s match %s\n", len(paths), bundlePath, directory)
+	return nil
+}
+
+// run is the main application logic
+func run(ctx context.Context, c *cli.Command) error {
+	if c.Bool("no-color") {
+		useColor = false
+	}
+
+	if langMap := c.String("lang-map"); langMap != "" {
+		if err := loadLanguageMap(langMap); err != nil {
+			return cli.Exit(fmt.Sprintf("Could not read language map %s: %v", langMap, err), 1)
+		}
+	}
+
+	if err := parseCommentStyles(c.StringSlice("comment-style")); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	if c.Bool("list-languages") {
+		printLanguages()
+		return nil
+	}
+
+	args := c.Args().Slice()
+
+	// Parse positional arguments
+	var directory, output string
+	switch {
+	case c.Bool("stdin"):
+		// There is no directory to scan, so the only argument is the output
+		directory = "."
+		if len(args) > 1 {
+			return cli.Exit("Too many arguments; --stdin only takes an output", 1)
+		}
+		if len(args) == 1 {
+			output = args[0]
+		}
+	case len(args) == 0:
+		directory = "."
+	case len(args) == 1:
+		directory = args[0]
+	case len(args) == 2:
+		directory = args[0]
+		output = args[1]
+	default:
+		return cli.Exit("Too many arguments", 1)
+	}
+
+	// Bound the whole run, including cloning and exporting
+	if timeout := c.Duration("timeout"); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Clone remote repositories into a temporary checkout
+	if isRemoteRepository(directory) {
+		if c.Bool("watch") {
+			return cli.Exit("--watch cannot be used with a remote repository", 1)
+		}
+		checkout, cleanup, err := cloneRepository(ctx, directory)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Could not clone %s: %v", directory, err), 1)
+		}
+		defer cleanup()
+		directory = checkout
+	}
+
+	// Export the tree at a git ref instead of reading the working tree
+	if ref := c.String("git-ref"); ref != "" {
+		if c.Bool("watch") {
+			return cli.Exit("--watch cannot be used with --git-ref", 1)
+		}
+		exported, cleanup, err := exportGitRef(ctx, directory, ref)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Could not read %s at %s: %v", directory, ref, err), 1)
+		}
+		defer cleanup()
+		directory = exported
+	}
+
+	// Unpack archives into a temporary directory
+	if isArchive(directory) {
+		if c.Bool("watch") {
+			return cli.Exit("--watch cannot be used with an archive", 1)
+		}
+		extracted, cleanup, err := extractArchive(directory)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Could not read archive %s: %v", directory, err), 1)
+		}
+		defer cleanup()
+		directory = extracted
+	}
+
+	// Create config
+	config := &Config{
+		Directory:             directory,
+		Output:                output,
+		OutputTemplate:        c.String("output-template"),
+		Format:                c.String("format"),
+		IncludeVCSDirectories: c.Bool("include-vcs"),
+		DeepNegation:          c.Bool("deep-negation"),
+		GitParity:             c.Bool("git-parity"),
+		Priority:              c.StringSlice("priority"),
+		Sort:                  c.String("sort"),
+		Dedup:                 c.Bool("dedup"),
+		Manifest:              c.Bool("manifest"),
+		IgnorePaths:           c.StringSlice("ignore-path"),
+		NoClobber:             c.Bool("no-clobber"),
+		Watch:                 c.Bool("watch"),
+		Interactive:           c.Bool("interactive"),
+		StripTrailingSpace:    c.Bool("strip-trailing-whitespace"),
+		CollapseBlankLines:    c.Bool("collapse-blank-lines"),
+		Verbose:               c.Bool("verbose"),
+		MaxDepth:              int(c.Int("max-depth")),
+		ExcludeExts:           parseExtensions(c.StringSlice("exclude-ext")),
+		ExtIgnoreCase:         c.Bool("ext-ignore-case") || defaultExtIgnoreCase,
+		IgnoreCase:            c.Bool("ignore-case"),
+		Index:                 c.Bool("index"),
+		CountOnly:             c.Bool("count-only"),
+		Wrap:                  int(c.Int("wrap")),
+		Include:               c.StringSlice("include"),
+		Exclude:               c.StringSlice("exclude"),
+		PatternsRelative:      c.String("patterns-relative"),
+		ExcludeDirs:           c.StringSlice("exclude-dir"),
+		NoHidden:              c.Bool("no-hidden"),
+		GroupByDir:            c.Bool("group-by-dir"),
+		AbsolutePaths:         c.Bool("absolute-paths"),
+		Strict:                c.Bool("strict"),
+		OnError:               c.String("on-error"),
+		OutputEncoding:        c.String("output-encoding"),
+		ReadRetries:           int(c.Int("read-retries")),
+		IncludeBinary:         !c.Bool("exclude-binary"),
+		MergeDirs:             c.StringSlice("merge"),
+		MaxTokens:             int(c.Int("max-tokens")),
+		MaxFiles:              int(c.Int("max-files")),
+		AnnotateTruncation:    c.Bool("annotate-truncation"),
+		FileTemplate:          c.String("file-template"),
+		EmitEmptyDirs:         c.Bool("emit-empty-dirs"),
+		NoteSymlinks:          c.Bool("note-symlinks"),
+		PreserveStructure:     c.Bool("preserve-structure"),
+		JSONCompact:           c.Bool("json-compact"),
+		NoEndMarker:           c.Bool("no-end-marker"),
+		NoTrailingNewline:     !c.Bool("trailing-newline"),
+		SectionSpacing:        c.Int("section-spacing"),
+		Highlight:             c.Bool("highlight"),
+		RootIgnoreOnly:        c.Bool("root-ignore-only"),
+		Stats:                 c.Bool("stats"),
+		Top:                   int(c.Int("top")),
+		SummaryJSON:           c.String("summary-json"),
+		BufferSize:            int(c.Int("buffer-size")),
+		BinarySniffBytes:      int(c.Int("binary-sniff-bytes")),
+		MaxRecursion:          int(c.Int("max-recursion")),
+		OnlyExts:              parseExtensions(c.StringSlice("only-ext")),
+		NativeSeparators:      c.Bool("native-separators"),
+		StdinList:             c.Bool("stdin-list"),
+		NullSeparated:         c.Bool("null"),
+		TruncateLarge:         int(c.Int("truncate-large")),
+		DiffAgainst:           c.String("diff-against"),
+		AppendTo:              c.String("append-to"),
+		NoHeader:              c.Bool("no-header"),
+		IncludeLockfiles:      c.Bool("include-lockfiles"),
+		NoDefaultExcludes:     c.Bool("no-default-excludes"),
+		ExcludeTestFiles:      c.Bool("exclude-test-files"),
+		ExcludeVendored:       c.Bool("exclude-vendored"),
+		ExcludeMinified:       c.Bool("exclude-minified"),
+	}
+
+	// Build the transformer chain in the order given
+	for _, name := range c.StringSlice("transform") {
+		transformer, err := newTransformer(strings.TrimSpace(name), config)
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		config.Transformers = append(config.Transformers, transformer)
+	}
+
+	// Load a custom header
+	if headerFile := c.String("header-file"); headerFile != "" {
+		if config.NoHeader {
+			return cli.Exit("--header-file cannot be used with --no-header", 1)
+		}
+		text, err := readHeaderFile(headerFile)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Could not read header file %s: %v", headerFile, err), 1)
+		}
+		config.Header = text
+	}
+
+	// Read the previous output before it can be overwritten
+	if config.DiffAgainst != "" {
+		previous, err := readBundleFile(config.DiffAgainst, config.SectionSpacing)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Could not read previous output %s: %v", config.DiffAgainst, err), 1)
+		}
+		config.PreviousFiles = previous
+	}
+	if config.AppendTo != "" {
+		// The output is the existing file, which is only added to
+		if config.DiffAgainst != "" || config.Output != "" || config.Manifest || config.Index || config.Watch || config.CountOnly || c.Bool("stdin") || len(c.StringSlice("also-format")) > 0 {
+			return cli.Exit("--append-to cannot be used with --diff-against, --manifest, --index, --watch, --count-only, --stdin, --also-format or an output argument", 1)
+		}
+		previous, err := readBundleFile(config.AppendTo, config.SectionSpacing)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Could not read previous output %s: %v", config.AppendTo, err), 1)
+		}
+		config.PreviousFiles = previous
+	}
+
+	// Parse size limits
+	if value := c.String("max-file-size"); value != "" {
+		size, err := parseSize(value)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Invalid --max-file-size: %v", err), 1)
+		}
+		config.MaxFileSize = size
+	}
+	if value := c.String("max-total-size"); value != "" {
+		size, err := parseSize(value)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Invalid --max-total-size: %v", err), 1)
+		}
+		config.MaxTotalSize = size
+	}
+
+	if config.BinarySniffBytes < -1 {
+		return cli.Exit("--binary-sniff-bytes must be -1 (the whole file) or more", 1)
+	}
+
+	// The file picker reads its answers from stdin
+	if config.Interactive && (config.StdinList || config.Watch) {
+		return cli.Exit("--interactive cannot be used with --stdin-list or --watch", 1)
+	}
+
+	if c.Bool("stdin") {
+		if config.StdinList || config.Interactive || config.Watch || config.CountOnly {
+			return cli.Exit("--stdin cannot be used with --stdin-list, --interactive, --watch or --count-only", 1)
+		}
+		// The limits are applied by the walk, which a content manifest skips
+		if config.MaxFiles > 0 || config.MaxTokens > 0 || config.MaxTotalSize > 0 {
+			return cli.Exit("--stdin cannot be used with --max-files, --max-tokens or --max-total-size", 1)
+		}
+		config.ContentInput = os.Stdin
+	}
+
+	// Read the list of files to consider before doing anything else
+	if config.StdinList {
+		listed, err := readPathList(os.Stdin, config.NullSeparated)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Could not read file list from stdin: %v", err), 1)
+		}
+		config.ListedFiles = listed
+	}
+
+	// Or only the uncommitted changes of the git work tree
+	if c.Bool("only-changed-git") {
+		if config.StdinList || config.Watch || c.String("git-ref") != "" {
+			return cli.Exit("--only-changed-git cannot be used with --stdin-list, --watch or --git-ref", 1)
+		}
+		changed, err := changedGitFiles(ctx, config.Directory)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Could not list changed files: %v", err), 1)
+		}
+		config.ListedFiles = changed
+	}
+
+	// Re-anchor CLI patterns written relative to the current directory
+	switch config.PatternsRelative {
+	case "root":
+	case "cwd":
+		config.Include = rebasePatterns(config.Include, config.Directory)
+		config.Exclude = rebasePatterns(config.Exclude, config.Directory)
+	default:
+		return cli.Exit(fmt.Sprintf("Invalid --patterns-relative value %q (expected root or cwd)", config.PatternsRelative), 1)
+	}
+
+	// Paths are written relative to another directory above the scanned one
+	if relativeTo := c.String("relative-to"); relativeTo != "" {
+		if config.AbsolutePaths {
+			return cli.Exit("--relative-to cannot be used with --absolute-paths", 1)
+		}
+		base, err := resolveRelativeTo(relativeTo, config.Directory)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Invalid --relative-to: %v", err), 1)
+		}
+		config.RelativeTo = base
+	}
+
+	switch config.OnError {
+	case "abort", "skip":
+	default:
+		return cli.Exit(fmt.Sprintf("Invalid --on-error value %q (expected abort or skip)", config.OnError), 1)
+	}
+
+	switch config.OutputEncoding {
+	case "utf8", "utf8-bom":
+	default:
+		return cli.Exit(fmt.Sprintf("Invalid --output-encoding value %q (expected utf8 or utf8-bom)", config.OutputEncoding), 1)
+	}
+
+	switch config.Sort {
+	case "name", "size", "mtime":
+	default:
+		return cli.Exit(fmt.Sprintf("Invalid --sort value %q (expected name, size or mtime)", config.Sort), 1)
+	}
+
+	// Without --format, the output file's extension picks the format
+	if !c.IsSet("format") && config.Output != "" {
+		config.Format = formatForOutput(config.Output)
+	}
+
+	// Select the output formatter
+	formatter, err := newFormatter(config)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	config.Formatter = formatter
+
+	// Parse the output name template before doing any work
+	nameTemplate, err := parseOutputTemplate(config.OutputTemplate)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Invalid output template: %v", err), 1)
+	}
+
+	// Select the additional formats
+	formatters := []Formatter{formatter}
+	for _, format := range c.StringSlice("also-format") {
+		extra := *config
+		extra.Format = format
+		formatter, err := newFormatter(&extra)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Invalid --also-format: %v", err), 1)
+		}
+		formatters = append(formatters, formatter)
+	}
+
+	// Format-specific options need one of the formats they apply to
+	var hasText, hasJSON bool
+	for _, formatter := range formatters {
+		switch formatter.(type) {
+		case textFormatter:
+			hasText = true
+		case *jsonFormatter:
+			hasJSON = true
+		}
+	}
+	if config.PreserveStructure && !hasJSON {
+		return cli.Exit("--preserve-structure only applies to --format json", 1)
+	}
+	if config.JSONCompact && !hasJSON {
+		return cli.Exit("--json-compact only applies to --format json", 1)
+	}
+	// The other formats need their closing tags or brackets
+	if config.NoEndMarker && !hasText {
+		return cli.Exit("--no-end-marker only applies to the text format", 1)
+	}
+	if config.SectionSpacing < 0 {
+		return cli.Exit("--section-spacing must not be negative", 1)
+	}
+	if config.SectionSpacing > 0 && !hasText {
+		return cli.Exit("--section-spacing only applies to the text format", 1)
+	}
+	if config.NoTrailingNewline && !hasText {
+		return cli.Exit("--trailing-newline=false only applies to the text format; the other formats keep content as it is", 1)
+	}
+	if _, ok := formatter.(textFormatter); config.AppendTo != "" && !ok {
+		return cli.Exit("--append-to only applies to the text format", 1)
+	}
+
+	// Determine output file path
+	outputPath, err := determineOutputPath(config.Directory, config.Output, nameTemplate, formatter.Extension(), config.NoClobber)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error determining output path: %v", err), 1)
+	}
+	if config.AppendTo != "" {
+		outputPath = config.AppendTo
+	}
+	config.OutputPath = outputPath
+
+	// Every additional format goes next to the output, with its own extension
+	written := map[string]bool{outputPath: true}
+	for _, extra := range formatters[1:] {
+		path := extraOutputPath(outputPath, formatter.Extension(), extra.Extension())
+		if written[path] {
+			return cli.Exit(fmt.Sprintf("--also-format would write to %s a second time; each format needs its own extension", path), 1)
+		}
+		written[path] = true
+		absPath, err := resolveOutputPath(path)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error determining output path: %v", err), 1)
+		}
+		config.ExtraOutputs = append(config.ExtraOutputs, ExtraOutput{Formatter: extra, Path: path, absPath: absPath})
+	}
+
+	// Profile the rest of the run if requested
+	if path := c.String("cpuprofile"); path != "" {
+		stop, err := startCPUProfile(path)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Could not start CPU profile: %v", err), 1)
+		}
+		defer stop()
+	}
+	if path := c.String("memprofile"); path != "" {
+		defer writeMemProfile(path)
+	}
+
+	config.Context = ctx
+
+	if config.CountOnly {
+		if err := countRepository(config); err != nil {
+			return cli.Exit(fmt.Sprintf("%v", err), 1)
+		}
+		return nil
+	}
+
+	if config.Watch {
+		if err := watchRepository(ctx, config); err != nil {
+			return cli.Exit(fmt.Sprintf("%v", err), 1)
+		}
+		return nil
+	}
+
+	if err := generate(config); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return cli.Exit(fmt.Sprintf("Timed out after %v; the output is incomplete", c.Duration("timeout")), TimeoutExitCode)
+		}
+		if errors.Is(err, context.Canceled) {
+			return cli.Exit("Interrupted; the output is incomplete", InterruptExitCode)
+		}
+		return cli.Exit(fmt.Sprintf("%v", err), 1)
+	}
+	return nil
+}
+
+// startCPUProfile starts CPU profiling into path and returns the function that stops it
+func startCPUProfile(path string) (func(), error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		file.Close()
+	}, nil
+}
+
+// writeMemProfile writes a heap profile to path
+func writeMemProfile(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		printWarning("Could not write memory profile: %v", err)
+		return
+	}
+	defer file.Close()
+
+	runtime.GC() // Get up-to-date statistics
+	if err := pprof.WriteHeapProfile(file); err != nil {
+		printWarning("Could not write memory profile: %v", err)
+	}
+}
+
+// isRemoteRepository reports whether the directory argument looks like a git URL
+func isRemoteRepository(directory string) bool {
+	for _, prefix := range []string{"https://", "http://", "ssh://", "git://", "file://", "git@"} {
+		if strings.HasPrefix(directory, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// repositoryName derives the repository name from a git URL
+func repositoryName(url string) string {
+	name := strings.TrimRight(url, "/")
+	name = strings.TrimSuffix(strings.TrimSuffix(name, "/.git"), ".git")
+	if i := strings.LastIndexAny(name, "/:"); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" {
+		name = "repository"
+	}
+	return name
+}
+
+// cloneRepository shallow-clones url into a temporary directory named after the
+// repository, so the default output name matches. The returned function removes it.
+func cloneRepository(ctx context.Context, url string) (string, func(), error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", nil, fmt.Errorf("git binary not found")
+	}
+
+	tempDir, err := os.MkdirTemp("", "unfolder-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tempDir) }
+
+	checkout := filepath.Join(tempDir, repositoryName(url))
+	cmd := exec.CommandContext(ctx, "git", "clone", "--quiet", "--depth", "1", url, checkout)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("git clone failed: %v", err)
+	}
+
+	return checkout, cleanup, nil
+}
+
+// exportGitRef writes the tree of ref in the git repository at dir (bare or not) to a
+// temporary directory named after the repository, so the default output name matches.
+// The returned function removes it.
+func exportGitRef(ctx context.Context, dir, ref string) (string, func(), error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", nil, fmt.Errorf("git binary not found")
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	name := strings.TrimSuffix(filepath.Base(absDir), ".git")
+	if name == "" || name == "." || name == string(filepath.Separator) {
+		name = "repository"
+	}
+
+	tempDir, err := os.MkdirTemp("", "unfolder-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tempDir) }
+
+	root := filepath.Join(tempDir, name)
+	if err := os.Mkdir(root, 0755); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", "-C", absDir, "archive", "--format=tar", ref)
+	cmd.Stderr = &stderr
+	stream, err := cmd.StdoutPipe()
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	untarErr := untar(stream, root)
+	// Drain whatever is left so git doesn't block on a full pipe
+	io.Copy(io.Discard, stream)
+	if err := cmd.Wait(); err != nil {
+		cleanup()
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", nil, fmt.Errorf("git archive failed: %s", msg)
+		}
+		return "", nil, fmt.Errorf("git archive failed: %v", err)
+	}
+	if untarErr != nil {
+		cleanup()
+		return "", nil, untarErr
+	}
+
+	return root, cleanup, nil
+}
+
+// changedGitFiles returns the files of the git work tree at dir that differ from HEAD,
+// staged or not, and the untracked ones, as slash-separated paths relative to dir.
+// Renamed and copied files count under their new name; deleted files are left out.
+func changedGitFiles(ctx context.Context, dir string) (map[string]bool, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git binary not found")
+	}
+
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "--is-inside-work-tree").Output()
+	if err != nil || strings.TrimSpace(string(out)) != "true" {
+		return nil, fmt.Errorf("%s is not inside a git work tree", dir)
+	}
+	// Porcelain paths are relative to the top of the work tree, not to dir
+	out, err = exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "--show-prefix").Output()
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimSuffix(string(out), "\n")
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", "-C", dir, "status", "--porcelain", "-z", "--untracked-files=all", "--", ".")
+	cmd.Stderr = &stderr
+	if out, err = cmd.Output(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git status failed: %s", msg)
+		}
+		return nil, fmt.Errorf("git status failed: %v", err)
+	}
+
+	// Each entry is "XY path", X for the index and Y for the work tree. Renames and
+	// copies are followed by an extra field holding the original path.
+	changed := make(map[string]bool)
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i < len(fields); i++ {
+		entry := fields[i]
+		if len(entry) < 4 {
+			continue
+		}
+		index, worktree, path := entry[0], entry[1], entry[3:]
+		if index == 'R' || index == 'C' {
+			i++
+		}
+		if worktree == 'D' || index == 'D' && worktree == ' ' {
+			continue
+		}
+		if relPath, ok := strings.CutPrefix(path, prefix); ok {
+			changed[relPath] = true
+		}
+	}
+	return changed, nil
+}
+
+// archiveExtensions lists the supported archive suffixes
+var archiveExtensions = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+// archiveStem returns the archive file name without its archive extension, or "" if
+// the path doesn't have a supported archive extension
+func archiveStem(path string) string {
+	name := filepath.Base(path)
+	lower := strings.ToLower(name)
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(lower, ext) && len(name) > len(ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return ""
+}
+
+// isArchive reports whether the directory argument is an archive file
+func isArchive(path string) bool {
+	if archiveStem(path) == "" {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// extractArchive unpacks a zip or tar archive into a temporary directory named after
+// the archive, so the default output name matches. The returned function removes it.
+func extractArchive(path string) (string, func(), error) {
+	tempDir, err := os.MkdirTemp("", "unfolder-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tempDir) }
+
+	root := filepath.Join(tempDir, archiveStem(path))
+	if err := os.Mkdir(root, 0755); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		err = extractZip(path, root)
+	} else {
+		err = extractTar(path, root)
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return root, cleanup, nil
+}
+
+// extractZip unpacks the regular files of a zip archive into root
+func extractZip(path, root string) error {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for _, entry := range reader.File {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		content, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		err = writeArchiveEntry(root, entry.Name, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractTar unpacks the regular files of a (optionally gzipped) tar archive into root
+func extractTar(path, root string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var stream io.Reader = file
+	lower := strings.ToLower(path)
+	if strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		stream = gz
+	}
+
+	return untar(stream, root)
+}
+
+// untar unpacks the regular files of a tar stream into root
+func untar(stream io.Reader, root string) error {
+	reader := tar.NewReader(stream)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := writeArchiveEntry(root, header.Name, reader); err != nil {
+			return err
+		}
+	}
+}
+
+// writeArchiveEntry writes one archive entry below root, skipping entries whose
+// names would escape it
+func writeArchiveEntry(root, name string, content io.Reader) error {
+	relPath := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(name, "/")))
+	if relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) || filepath.IsAbs(relPath) {
+		printWarning("Skipping archive entry outside the archive root: %s", name)
+		return nil
+	}
+
+	target := filepath.Join(root, relPath)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, content)
+	return err
+}
+
+// generate writes the complete output file once and reports the result
+func generate(config *Config) error {
+	stats, err := Unfold(config)
+
+	// The summary goes to stderr when stdout carries the JSON summary
+	out := io.Writer(os.Stdout)
+	if config.SummaryJSON != "" {
+		if config.SummaryJSON == "-" {
+			out = os.Stderr
+		}
+		// Written for failed and partial runs too, as long as there is something to report
+		if stats != nil {
+			if err := writeSummaryJSON(config.SummaryJSON, stats); err != nil {
+				printWarning("Could not write summary: %v", err)
+			}
+		}
+	}
+
+	if stoppedEarly(err) && stats != nil {
+		fmt.Fprintf(out, "Partial repository contents written to %s (%d file(s) before stopping)\n", config.OutputPath, stats.Files)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Repository contents written to %s (%d file(s), %d skipped, ~%d tokens)\n", config.OutputPath, stats.Files, stats.totalSkipped(), stats.Tokens)
+	for _, extra := range config.ExtraOutputs {
+		fmt.Fprintf(out, "Repository contents also written to %s\n", extra.Path)
+	}
+
+	if config.Stats {
+		printExtensionStats(out, stats)
+	}
+	if config.Top > 0 {
+		printLargestFiles(out, stats, config.Top)
+	}
+
+	// Skipped read errors only fail the run in strict mode
+	if failed := stats.Skipped[SkipError]; failed > 0 && config.Strict {
+		return fmt.Errorf("%d file(s) or directories could not be read", failed)
+	}
+
+	// An output with only a header is almost always a misconfiguration. With
+	// --diff-against and --append-to it just means nothing changed.
+	if stats.Files == 0 && config.PreviousFiles == nil {
+		message := fmt.Sprintf("No files were included in %s (%d skipped); check your ignore patterns and filters, or use --include-vcs if the files are inside a VCS directory", config.OutputPath, stats.totalSkipped())
+		if config.Strict {
+			return errors.New(message)
+		}
+		printWarning("%s", message)
+	}
+
+	// Show warning summary if any warnings occurred
+	if len(warnings) > 0 {
+		fmt.Fprintf(os.Stderr, "\n%s\n", colorize(colorYellow, fmt.Sprintf("Note: %d warning(s) occurred during processing; see the messages above.", len(warnings))))
+	}
+
+	return nil
+}
+
+// Unfold writes the repository in config.Directory to config.OutputPath and
+// returns what was written and skipped. The formatter is derived from
+// config.Format when config.Formatter is nil.
+func Unfold(config *Config) (*Stats, error) {
+	warnings = nil
+
+	if config.Formatter == nil {
+		formatter, err := newFormatter(config)
+		if err != nil {
+			return nil, err
+		}
+		config.Formatter = formatter
+	}
+
+	// Additional formats are written alongside through a teeFormatter
+	if len(config.ExtraOutputs) > 0 {
+		tee, err := newTeeFormatter(config)
+		if err != nil {
+			return nil, err
+		}
+		primary := config.Formatter
+		config.Formatter = tee
+		defer func() { config.Formatter = primary }()
+		defer tee.Close()
+	}
+
+	var stats *Stats
+	var err error
+	if config.ContentInput != nil {
+		stats, err = processContentManifest(config.ContentInput, config.OutputPath, config)
+	} else {
+		stats, err = processRepository(config.Directory, config.OutputPath, config)
+	}
+	if stats != nil {
+		// Always an array in --summary-json, even without warnings
+		stats.Warnings = append([]string{}, warnings...)
+	}
+	return stats, err
+}
+
+// writeSummaryJSON writes the run's stats as JSON to path, or to stdout for -
+func writeSummaryJSON(path string, stats *Stats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// printExtensionStats prints files and bytes per extension, largest first
+func printExtensionStats(w io.Writer, stats *Stats) {
+	extensions := make([]string, 0, len(stats.ByExtension))
+	for ext := range stats.ByExtension {
+		extensions = append(extensions, ext)
+	}
+	sort.Slice(extensions, func(i, j int) bool {
+		a, b := stats.ByExtension[extensions[i]], stats.ByExtension[extensions[j]]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return extensions[i] < extensions[j]
+	})
+
+	fmt.Fprintf(w, "\n%d file(s), %d bytes\n", stats.Files, stats.Bytes)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "FILES\tBYTES\t  EXTENSION")
+	for _, ext := range extensions {
+		name := ext
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(tw, "%d\t%d\t  %s\n", stats.ByExtension[ext].Files, stats.ByExtension[ext].Bytes, name)
+	}
+	tw.Flush()
+}
+
+// printLargestFiles prints the n largest written files, largest first
+func printLargestFiles(w io.Writer, stats *Stats, n int) {
+	paths := make([]string, 0, len(stats.ByFile))
+	for path := range stats.ByFile {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := stats.ByFile[paths[i]], stats.ByFile[paths[j]]
+		if a != b {
+			return a > b
+		}
+		return paths[i] < paths[j]
+	})
+	if len(paths) > n {
+		paths = paths[:n]
+	}
+
+	fmt.Fprintf(w, "\nLargest %d file(s)\n", len(paths))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "BYTES\t  PATH")
+	for _, path := range paths {
+		fmt.Fprintf(tw, "%d\t  %s\n", stats.ByFile[path], path)
+	}
+	tw.Flush()
+}
+
+// watchRepository regenerates the output on every relevant change until interrupted
+func watchRepository(ctx context.Context, config *Config) error {
+	absDir, err := filepath.Abs(config.Directory)
+	if err != nil {
+		return err
+	}
+	resolvedDir, err := filepath.EvalSymlinks(absDir)
+	if err != nil {
+		return fmt.Errorf("could not resolve directory path %s: %v", absDir, err)
+	}
+	absOutput, err := resolveOutputPath(config.OutputPath)
+	if err != nil {
+		return err
+	}
+
+	if err := generate(config); err != nil {
+		return err
+	}
+	// Later runs rewrite the output chosen by the first one
+	config.NoClobber = false
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	ignorePatterns, err := loadIgnorePatterns(resolvedDir, config)
+	if err != nil {
+		return err
+	}
+	if err := addWatchDirs(watcher, resolvedDir, resolvedDir, ignorePatterns, config); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Watching %s for changes (Ctrl-C to stop)\n", resolvedDir)
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(os.Stderr, "Stopped watching")
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !isRelevantChange(event, resolvedDir, absOutput, ignorePatterns, config) {
+				continue
+			}
+			// Start watching directories created after startup
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					addWatchDirs(watcher, resolvedDir, event.Name, ignorePatterns, config)
+				}
+			}
+			debounce = time.After(WatchDebounce)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			printWarning("Watch error: %v", err)
+
+		case <-debounce:
+			debounce = nil
+			fmt.Printf("[%s] Change detected, regenerating\n", time.Now().Format("15:04:05"))
+			if err := generate(config); err != nil {
+				printWarning("Regeneration failed: %v", err)
+			}
+			// Ignore files may have changed as well
+			if patterns, err := loadIgnorePatterns(resolvedDir, config); err == nil {
+				ignorePatterns = patterns
+			}
+		}
+	}
+}
+
+// addWatchDirs adds root and every non-ignored directory below it to the watcher
+func addWatchDirs(watcher *fsnotify.Watcher, absDir, root string, ignorePatterns []IgnorePattern, config *Config) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsPermission(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(absDir, path)
+		if err != nil {
+			return nil
+		}
+		if relPath != "." && (isExcludedDir(relPath, config) || skipsHidden(relPath, true, config) || exceedsMaxDepth(relPath, config) || exceedsRecursionLimit(relPath, config)) {
+			return filepath.SkipDir
+		}
+		if relPath != "." && prunesIgnoredDir(relPath, ignorePatterns, config) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// isRelevantChange reports whether a filesystem event should trigger a regeneration
+func isRelevantChange(event fsnotify.Event, absDir, absOutput string, ignorePatterns []IgnorePattern, config *Config) bool {
+	if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+		return false
+	}
+
+	// Our own writes must not trigger another run
+	if isOutputFile(event.Name, absOutput, config) {
+		return false
+	}
+
+	relPath, err := filepath.Rel(absDir, event.Name)
+	if err != nil || relPath == "." {
+		return false
+	}
+
+	// Ignore files always matter, even though they may ignore themselves
+	switch filepath.Base(relPath) {
+	case ".gitignore", ".unfolderignore":
+		return true
+	}
+	info, err := os.Stat(event.Name)
+	return !shouldIgnore(relPath, err == nil && info.IsDir(), ignorePatterns, config)
+}
+
+// parseOutputTemplate parses the --output-template value
+func parseOutputTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultOutputTemplate
+	}
+	return template.New("output").Option("missingkey=error").Parse(text)
+}
+
+// parseFileTemplate parses the --file-template value, turning \n and \t into
+// newlines and tabs, and tries it on sample data so mistakes surface before any work
+func parseFileTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultFileTemplate
+	}
+	text = strings.NewReplacer(`\n`, "\n", `\t`, "\t").Replace(text)
+	fileTemplate, err := template.New("file").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := FileData{Divider: SectionDivider, Path: "main.go", Content: "package main\n", Size: 13, Language: "go"}
+	if err := fileTemplate.Execute(io.Discard, sample); err != nil {
+		return nil, err
+	}
+	return fileTemplate, nil
+}
+
+// readHeaderFile reads a custom header and fills in its placeholders
+func readHeaderFile(path string) (string, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	headerTemplate, err := template.New("header").Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return "", err
+	}
+
+	var header strings.Builder
+	data := HeaderData{Divider: SectionDivider, EndMarker: EndMarker}
+	if err := headerTemplate.Execute(&header, data); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(header.String(), "\n"), nil
+}
+
+// renderOutputName executes the output name template for the given directory
+func renderOutputName(nameTemplate *template.Template, baseName, ext string) (string, error) {
+	now := time.Now()
+	data := OutputNameData{
+		Base: baseName,
+		Date: now.Format("2006-01-02"),
+		Time: now.Format("150405"),
+		Ext:  ext,
+	}
+
+	var name strings.Builder
+	if err := nameTemplate.Execute(&name, data); err != nil {
+		return "", err
+	}
+	if name.Len() == 0 {
+		return "", fmt.Errorf("output template produced an empty filename")
+	}
+	return name.String(), nil
+}
+
+func determineOutputPath(directory, output string, nameTemplate *template.Template, ext string, noClobber bool) (string, error) {
+	// Get the base directory name
+	absDir, err := filepath.Abs(directory)
+	if err != nil {
+		return "", err
+	}
+	baseName := filepath.Base(absDir)
+	defaultFilename, err := renderOutputName(nameTemplate, baseName, ext)
+	if err != nil {
+		return "", err
+	}
+
+	var outputPath string
+	switch {
+	case output == "":
+		// No output specified, use current directory
+		outputPath = defaultFilename
+	case strings.HasSuffix(output, "/") || strings.HasSuffix(output, "\\"):
+		// Output is a directory
+		outputPath = filepath.Join(output, defaultFilename)
+	default:
+		// Output is a file path
+		outputPath = output
+	}
+
+	if noClobber {
+		return nextFreePath(outputPath)
+	}
+	return outputPath, nil
+}
+
+// nextFreePath returns path, or the first name-N.ext variant of it that doesn't exist yet
+func nextFreePath(path string) (string, error) {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+
+	candidate := path
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate, nil
+		} else if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s-%d%s", stem, i, ext)
+	}
+}
+
+func processRepository(directory, outputPath string, config *Config) (*Stats, error) {
+	resolvedDir, ignorePatterns, cleanup, err := prepareRepository(directory, config)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	absOutput, err := resolveOutputPath(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create output file and write header, or reopen the file to append to
+	var output *outputWriter
+	var tail []byte // Text after the end marker of the file appended to
+	if config.AppendTo != "" {
+		output, tail, err = openForAppend(outputPath, config)
+	} else {
+		output, err = createOutputFile(outputPath, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer output.Close()
+
+	// Walk through files using the resolved directory. On a timeout or interrupt,
+	// what was written so far is still ended properly.
+	stats, walkErr := walkAndProcessFiles(resolvedDir, absOutput, ignorePatterns, output, config)
+	if stats == nil {
+		stats = newStats()
+	}
+	if walkErr != nil && !stoppedEarly(walkErr) {
+		writeStatsRecord(output, stats, walkErr, config)
+		return stats, walkErr
+	}
+
+	// Write --END-- marker
+	if err := writeEnd(output, config.Formatter); err != nil {
+		printWarning("Could not write end marker: %v", err)
+	}
+	if _, err := output.Write(tail); err != nil {
+		return stats, err
+	}
+	stats.OutputBytes = output.Offset()
+	stats.Tokens = estimateTokens(stats.OutputBytes)
+	writeStatsRecord(output, stats, walkErr, config)
+
+	if err := output.Close(); err != nil {
+		return stats, err
+	}
+	return stats, walkErr
+}
+
+// openForAppend reopens an existing text output for --append-to. The end marker and
+// anything after it are cut off, so new sections go where the marker was; the text
+// that followed the marker is returned to be written again after the new marker.
+func openForAppend(path string, config *Config) (*outputWriter, []byte, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Like parseBundle, take the first line that equals the end marker
+	var offset int64
+	var tail []byte
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r") == EndMarker {
+			if tail, err = io.ReadAll(reader); err != nil {
+				file.Close()
+				return nil, nil, err
+			}
+			break
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			// Without an end marker, the new sections simply follow
+			if len(line) > 0 && !strings.HasSuffix(line, "\n") {
+				if _, err := file.WriteAt([]byte("\n"), offset); err != nil {
+					file.Close()
+					return nil, nil, err
+				}
+				offset++
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	output := newOutputWriter(file, config.BufferSize)
+	output.offset = offset
+	return output, tail, nil
+}
+
+// statsWriter is implemented by formatters that end the output with the run's stats
+type statsWriter interface {
+	WriteStats(w io.Writer, stats *Stats, runErr error) error
+}
+
+// writeStatsRecord ends the output with the stats when the formatter supports it.
+// It also runs after a failure, so consumers learn how far the run got and why it stopped.
+func writeStatsRecord(output *outputWriter, stats *Stats, runErr error, config *Config) {
+	sw, ok := config.Formatter.(statsWriter)
+	if !ok {
+		return
+	}
+	if stats == nil {
+		stats = newStats()
+	}
+	if runErr != nil {
+		stats.OutputBytes = output.Offset()
+		stats.Tokens = estimateTokens(stats.OutputBytes)
+	}
+	stats.Warnings = append([]string{}, warnings...)
+	if err := sw.WriteStats(output, stats, runErr); err != nil {
+		printWarning("Could not write stats: %v", err)
+		return
+	}
+	if err := output.Flush(); err != nil {
+		printWarning("Could not write stats: %v", err)
+	}
+}
+
+// processContentManifest writes the files of a content manifest instead of a directory.
+// Each entry is a line with the path, a line with the content length in bytes, and
+// then exactly that many bytes of content. Blank lines between entries are ignored.
+func processContentManifest(r io.Reader, outputPath string, config *Config) (*Stats, error) {
+	entries, contents, err := readContentManifest(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest: %v", err)
+	}
+	for i := range contents {
+		contents[i] = transformContent(entries[i].RelPath, contents[i], config)
+	}
+
+	output, err := createOutputFile(outputPath, config)
+	if err != nil {
+		return nil, err
+	}
+	defer output.Close()
+
+	if config.Manifest {
+		for i := range entries {
+			entries[i].Size = int64(len(contents[i]))
+			entries[i].Lines = countLines(contents[i])
+		}
+		if err := config.Formatter.WriteManifest(output, entries); err != nil {
+			return nil, err
+		}
+	}
+
+	state := &writeState{seen: make(map[[sha256.Size]byte]string), stats: newStats()}
+	for i, entry := range entries {
+		if err := writeSection(entry.RelPath, contents[i], output, config, state); err != nil {
+			writeStatsRecord(output, state.stats, err, config)
+			return state.stats, err
+		}
+	}
+
+	if err := writeEnd(output, config.Formatter); err != nil {
+		printWarning("Could not write end marker: %v", err)
+	}
+	state.stats.OutputBytes = output.Offset()
+	state.stats.Tokens = estimateTokens(state.stats.OutputBytes)
+	writeStatsRecord(output, state.stats, nil, config)
+
+	return state.stats, output.Close()
+}
+
+// readContentManifest parses a content manifest into entries and their contents
+func readContentManifest(r io.Reader) ([]FileEntry, [][]byte, error) {
+	var entries []FileEntry
+	var contents [][]byte
+
+	reader := bufio.NewReader(r)
+	for {
+		path, err := reader.ReadString('\n')
+		path = strings.TrimSuffix(strings.TrimSuffix(path, "\n"), "\r")
+		if err == io.EOF && path == "" {
+			return entries, contents, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if path == "" {
+			continue
+		}
+
+		lengthLine, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, nil, fmt.Errorf("missing content length for %s", path)
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(lengthLine))
+		if err != nil || length < 0 {
+			return nil, nil, fmt.Errorf("invalid content length for %s: %q", path, strings.TrimSpace(lengthLine))
+		}
+
+		content := make([]byte, length)
+		if _, err := io.ReadFull(reader, content); err != nil {
+			return nil, nil, fmt.Errorf("content of %s is shorter than %d bytes", path, length)
+		}
+
+		entries = append(entries, FileEntry{Path: path, RelPath: path})
+		contents = append(contents, content)
+	}
+}
+
+// prepareRepository resolves the root directory and loads its ignore rules.
+// The returned cleanup function must be called once the walk is done.
+func prepareRepository(directory string, config *Config) (string, []IgnorePattern, func(), error) {
+	// Get absolute path and resolve symlinks for the root directory FIRST
+	absDir, err := filepath.Abs(directory)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	// FIXED: Resolve symlinks for the root directory
+	// This ensures that if the root directory is a symlink, we work with the actual directory
+	resolvedDir, err := filepath.EvalSymlinks(absDir)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("could not resolve directory path %s: %v", absDir, err)
+	}
+
+	// In git parity mode, let git decide what .gitignore excludes
+	cleanup := func() {}
+	if config.GitParity {
+		checker, err := newGitIgnoreChecker(resolvedDir)
+		if err != nil {
+			printWarning("Git parity unavailable, falling back to built-in matcher: %v", err)
+		} else {
+			config.GitChecker = checker
+			cleanup = func() {
+				checker.Close()
+				config.GitChecker = nil
+			}
+		}
+	}
+
+	// Load ignore patterns using the resolved directory
+	ignorePatterns, err := loadIgnorePatterns(resolvedDir, config)
+	if err != nil {
+		cleanup()
+		return "", nil, nil, err
+	}
+
+	return resolvedDir, ignorePatterns, cleanup, nil
+}
+
+// countRepository runs the file selection and reports totals without writing any output
+func countRepository(config *Config) error {
+	resolvedDir, ignorePatterns, cleanup, err := prepareRepository(config.Directory, config)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// A previous output in the tree would be excluded by a real run, so exclude it here too
+	absOutput, err := resolveOutputPath(config.OutputPath)
+	if err != nil {
+		return err
+	}
+
+	stats := newStats()
+	files, err := collectFiles(resolvedDir, absOutput, ignorePatterns, stats, config)
+	if err != nil {
+		return err
+	}
+	files = measureFiles(files, stats, config)
+
+	var totalBytes int64
+	for _, file := range files {
+		totalBytes += file.Size
+	}
+
+	fmt.Printf("Files: %d\n", len(files))
+	fmt.Printf("Bytes: %d\n", totalBytes)
+	fmt.Printf("Estimated tokens: %d\n", estimateTokens(totalBytes))
+	return nil
+}
+
+// estimateTokens approximates the token count of text using the common 4 bytes per token rule
+func estimateTokens(bytes int64) int64 {
+	return (bytes + BytesPerToken - 1) / BytesPerToken
+}
+
+// resolveOutputPath returns the absolute output path with symlinks in its directory
+// resolved, so it compares equal to paths seen while walking the resolved root
+func resolveOutputPath(outputPath string) (string, error) {
+	absOutput, err := filepath.Abs(outputPath)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(absOutput))
+	if err != nil {
+		// The directory doesn't exist (yet), so it can't be inside the walked tree either
+		return absOutput, nil
+	}
+	return filepath.Join(dir, filepath.Base(absOutput)), nil
+}
+
+// isOutputFile reports whether path is a file written by this run
+func isOutputFile(path, absOutput string, config *Config) bool {
+	for _, extra := range config.ExtraOutputs {
+		if path == extra.absPath {
+			return true
+		}
+	}
+	return path == absOutput || (config.Index && path == indexPath(absOutput))
+}
+
+// extraOutputPath derives the path of an --also-format output from the output path,
+// replacing the primary format's extension (or whatever extension it has) with ext
+func extraOutputPath(outputPath, primaryExt, ext string) string {
+	base, ok := strings.CutSuffix(outputPath, "."+primaryExt)
+	if !ok {
+		base = strings.TrimSuffix(outputPath, filepath.Ext(outputPath))
+	}
+	return base + "." + ext
+}
+
+// createOutputFile creates the output file and writes the header
+func createOutputFile(outputPath string, config *Config) (*outputWriter, error) {
+	output, err := openOutputFile(outputPath, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Formatter.WriteHeader(output, headerDescription(config.Formatter, config)); err != nil {
+		output.Close()
+		return nil, err
+	}
+	return output, nil
+}
+
+// openOutputFile creates an output file, starting it with the byte order mark if requested
+func openOutputFile(outputPath string, config *Config) (*outputWriter, error) {
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if config.NoClobber {
+		// Refuse to truncate a file that appeared after the output path was chosen
+		flags = os.O_RDWR | os.O_CREATE | os.O_EXCL
+	}
+	file, err := os.OpenFile(outputPath, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	output := newOutputWriter(file, config.BufferSize)
+
+	// Some Windows editors and ingestion tools only detect UTF-8 by its byte order mark
+	if config.OutputEncoding == "utf8-bom" {
+		if _, err := io.WriteString(output, UTF8BOM); err != nil {
+			output.Close()
+			return nil, err
+		}
+	}
+	return output, nil
+}
+
+// headerDescription returns the description written at the top of the output:
+// the formatter's own, replaced or left out if requested
+func headerDescription(formatter Formatter, config *Config) string {
+	if config.NoHeader {
+		return ""
+	}
+	if config.Header != "" {
+		return config.Header
+	}
+	return formatter.Description()
+}
+
+// resolveRelativeTo resolves the --relative-to directory and checks that it contains directory
+func resolveRelativeTo(relativeTo, directory string) (string, error) {
+	base, err := filepath.Abs(relativeTo)
+	if err != nil {
+		return "", err
+	}
+	// Compare resolved paths, as files are found below the resolved root
+	if base, err = filepath.EvalSymlinks(base); err != nil {
+		return "", err
+	}
+	absDir, err := filepath.Abs(directory)
+	if err != nil {
+		return "", err
+	}
+	if absDir, err = filepath.EvalSymlinks(absDir); err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(base, absDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not inside %s", directory, relativeTo)
+	}
+	return base, nil
+}
+
+// displayPath returns the path as written to the output: with forward slashes,
+// unless --native-separators is set
+func displayPath(relPath string, config *Config) string {
+	if config.NativeSeparators {
+		return relPath
+	}
+	return filepath.ToSlash(relPath)
+}
+
+// collectMergedFiles collects the files of a --merge directory
+func collectMergedFiles(dir, absOutput string, stats *Stats, config *Config) ([]FileEntry, error) {
+	resolvedDir, ignorePatterns, cleanup, err := prepareRepository(dir, config)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	return collectFiles(resolvedDir, absOutput, ignorePatterns, stats, config)
+}
+
+// disambiguatePaths gives files whose display path was already taken by an earlier
+// input directory a path prefixed with the name of their own input directory
+func disambiguatePaths(files []FileEntry) {
+	taken := make(map[string]bool)
+	for _, file := range files {
+		taken[file.RelPath] = true
+	}
+
+	emitted := make(map[string]bool)
+	for i, file := range files {
+		if !emitted[file.RelPath] {
+			emitted[file.RelPath] = true
+			continue
+		}
+
+		prefix := filepath.Base(file.Root)
+		unique := path.Join(prefix, file.RelPath)
+		for n := 2; taken[unique]; n++ {
+			unique = path.Join(fmt.Sprintf("%s-%d", prefix, n), file.RelPath)
+		}
+		printWarning("%s appears in more than one input directory; writing the copy from %s as %s", file.RelPath, file.Root, unique)
+		files[i].RelPath = unique
+		taken[unique] = true
+		emitted[unique] = true
+	}
+}
+
+// filterChanged drops files whose content matches the previous output and returns
+// the previously bundled paths that are no longer present
+func filterChanged(files []FileEntry, config *Config) ([]FileEntry, []string) {
+	previousOutput := config.DiffAgainst
+	if config.AppendTo != "" {
+		previousOutput = config.AppendTo
+	}
+	current := make(map[string]bool)
+	var changed []FileEntry
+	for _, file := range files {
+		current[file.RelPath] = true
+
+		previous, ok := config.PreviousFiles[file.RelPath]
+		if ok {
+			content, _, err := readFileContent(file, config)
+			if err == nil && sameBundledContent(previous, content) {
+				printVerbose(config, "Skipping %s: unchanged since %s", file.RelPath, previousOutput)
+				continue
+			}
+		}
+		changed = append(changed, file)
+	}
+
+	var removed []string
+	for relPath := range config.PreviousFiles {
+		if !current[relPath] {
+			removed = append(removed, relPath)
+		}
+	}
+	sort.Strings(removed)
+	return changed, removed
+}
+
+// sameBundledContent compares content as the text format stores it, where a
+// missing final newline is added on output unless --trailing-newline=false was set
+func sameBundledContent(bundled, content []byte) bool {
+	if bytes.Equal(bundled, content) {
+		return true
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content[:len(content):len(content)], '\n')
+	}
+	return string(bundled) == string(content)
+}
+
+// outputWriter buffers writes to the output file and tracks how many bytes were written
+type outputWriter struct {
+	file   *os.File
+	buffer *bufio.Writer
+	offset int64 // Bytes written so far, including buffered ones
+	closed bool
+}
+
+// newOutputWriter wraps file in a write buffer of the given size
+func newOutputWriter(file *os.File, size int) *outputWriter {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &outputWriter{file: file, buffer: bufio.NewWriterSize(file, size)}
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	n, err := w.buffer.Write(p)
+	w.offset += int64(n)
+	return n, err
+}
+
+// Offset returns the position of the next byte written
+func (w *outputWriter) Offset() int64 {
+	return w.offset
+}
+
+// Flush writes any buffered data to the file
+func (w *outputWriter) Flush() error {
+	return w.buffer.Flush()
+}
+
+// Close flushes the buffer and closes the file; closing twice is a no-op
+func (w *outputWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	flushErr := w.buffer.Flush()
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// countingWriter counts the bytes written to it and discards them
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// walkAndProcessFiles collects the files to include, orders them and writes each one
+func walkAndProcessFiles(absDir, absOutput string, ignorePatterns []IgnorePattern, output *outputWriter, config *Config) (*Stats, error) {
+	stats := newStats()
+	config.WalkedDirs = nil
+	config.Symlinks = nil
+	files, err := collectFiles(absDir, absOutput, ignorePatterns, stats, config)
+	if err != nil {
+		return stats, err
+	}
+
+	// Add the files of --merge directories, each with its own ignore rules
+	for _, dir := range config.MergeDirs {
+		merged, err := collectMergedFiles(dir, absOutput, stats, config)
+		if err != nil {
+			return stats, err
+		}
+		files = append(files, merged...)
+	}
+
+	files = orderFiles(files, config)
+
+	if config.Interactive {
+		if files, err = pickFiles(files, os.Stdin, os.Stderr); err != nil {
+			return stats, err
+		}
+	}
+
+	// From here on paths are only written out, so switch to their display form
+	for i := range files {
+		files[i].RelPath = displayPathOf(files[i], config)
+	}
+	if len(config.MergeDirs) > 0 {
+		disambiguatePaths(files)
+	}
+
+	// Compare against the previous output, remembering what no longer exists
+	var removed []string
+	var present []string // Files that exist but aren't written, so their directories aren't empty
+	if config.PreviousFiles != nil {
+		all := files
+		files, removed = filterChanged(files, config)
+		// Sections can't be taken out of the file appended to, so removals aren't recorded
+		if config.AppendTo != "" {
+			removed = nil
+		}
+		if config.EmitEmptyDirs {
+			changed := make(map[string]bool)
+			for _, file := range files {
+				changed[file.Path] = true
+			}
+			for _, file := range all {
+				if !changed[file.Path] {
+					present = append(present, file.Path)
+				}
+			}
+		}
+	}
+
+	if config.MaxTokens > 0 {
+		files = selectWithinBudget(files, output.Offset(), stats, config)
+	}
+
+	if config.Manifest {
+		files = measureFiles(files, stats, config)
+		if err := config.Formatter.WriteManifest(output, files); err != nil {
+			return stats, err
+		}
+	}
+
+	state := &writeState{seen: make(map[[sha256.Size]byte]string), stats: stats}
+	// Like --max-tokens, keep room for the end of the output
+	state.outputBytes = output.Offset() + endCost(config)
+	group := ""
+	written := present
+	for i, file := range files {
+		if err := contextErr(config); err != nil {
+			return state.stats, err
+		}
+		if config.GroupByDir {
+			relPath, _ := filepath.Rel(file.Root, file.Path)
+			// The banner waits for the first section, since files may still be skipped
+			if dir := topLevelDir(relPath); dir != group {
+				group = dir
+				state.group = dir
+			}
+		}
+		before := state.stats.Files
+		if err := processFile(file, output, config, state); err != nil {
+			return state.stats, err
+		}
+		files[i].content = nil
+		if state.stats.Files > before {
+			written = append(written, file.Path)
+		}
+	}
+	if state.capped > 0 {
+		printWarning("Left out %d file(s) to stay within --max-files %d (use --verbose to list them)", state.capped, config.MaxFiles)
+	}
+
+	if config.EmitEmptyDirs {
+		for _, dir := range emptyDirs(config.WalkedDirs, written) {
+			relPath := displayPathOf(dir, config) + "/"
+			if err := writeWithinTotalSize(relPath, output, config, state, func(f Formatter, w io.Writer) error {
+				return f.WriteEmptyDir(w, relPath)
+			}); err != nil {
+				return state.stats, err
+			}
+		}
+	}
+
+	for _, link := range config.Symlinks {
+		relPath := displayPathOf(link, config)
+		if err := writeWithinTotalSize(relPath, output, config, state, func(f Formatter, w io.Writer) error {
+			return f.WriteSymlink(w, relPath, link.LinkTarget)
+		}); err != nil {
+			return state.stats, err
+		}
+	}
+
+	for _, relPath := range removed {
+		if err := writeWithinTotalSize(relPath, output, config, state, func(f Formatter, w io.Writer) error {
+			return f.WriteRemoved(w, relPath)
+		}); err != nil {
+			return state.stats, err
+		}
+	}
+	if len(state.dropped) > 0 {
+		printWarning("Left out %d file(s) to stay within --max-total-size: %s", len(state.dropped), strings.Join(state.dropped, ", "))
+	}
+
+	if config.Index {
+		if err := writeIndex(indexPath(config.OutputPath), config.OutputPath, state.index); err != nil {
+			return state.stats, err
+		}
+	}
+	return state.stats, nil
+}
+
+// contextErr returns the error of config.Context once it is done, so long
+// walks and writes can stop early
+func contextErr(config *Config) error {
+	if config.Context == nil {
+		return nil
+	}
+	return config.Context.Err()
+}
+
+// stoppedEarly reports whether err means the run was cut short by --timeout or Ctrl-C
+func stoppedEarly(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// displayPathOf returns the path a file or directory is written under
+func displayPathOf(file FileEntry, config *Config) string {
+	relPath := file.RelPath
+	if config.AbsolutePaths {
+		relPath = file.Path
+	} else if config.RelativeTo != "" {
+		if rel, err := filepath.Rel(config.RelativeTo, file.Path); err == nil {
+			relPath = rel
+		}
+	}
+	return displayPath(relPath, config)
+}
+
+// emptyDirs returns the walked directories without any written file below them,
+// leaving out those inside another such directory
+func emptyDirs(dirs []FileEntry, written []string) []FileEntry {
+	occupied := make(map[string]bool)
+	for _, path := range written {
+		for dir := filepath.Dir(path); !occupied[dir]; dir = filepath.Dir(dir) {
+			occupied[dir] = true
+		}
+	}
+
+	var empty []FileEntry
+	last := ""
+	for _, dir := range dirs {
+		// The walk visits a directory before its subdirectories
+		if occupied[dir.Path] || last != "" && strings.HasPrefix(dir.Path, last+string(filepath.Separator)) {
+			continue
+		}
+		empty = append(empty, dir)
+		last = dir.Path
+	}
+	return empty
+}
+
+// collectFiles walks through the directory and returns the files to include in walk order
+func collectFiles(absDir, absOutput string, ignorePatterns []IgnorePattern, stats *Stats, config *Config) ([]FileEntry, error) {
+	var files []FileEntry
+	config.Attributes = nil
+	err := filepath.WalkDir(absDir, func(path string, d fs.DirEntry, err error) error {
+		if err := contextErr(config); err != nil {
+			return err
+		}
+		if err != nil {
+			// Handle permission errors for directories
+			if os.IsPermission(err) {
+				printWarning("Permission denied accessing %s: %v", path, err)
+				stats.skip(SkipPermission)
+				return filepath.SkipDir // Skip this directory and its contents
+			}
+			// The root itself failing is always fatal
+			if path == absDir {
+				return err
+			}
+			if err := handleReadError(path, err, stats, config); err != nil {
+				return err
+			}
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Never read our own output, wherever it sits in the tree
+		if !d.IsDir() && isOutputFile(path, absOutput, config) {
+			return nil
+		}
+
+		// Get relative path for ignore checking
+		relPath, err := filepath.Rel(absDir, path)
+		if err != nil {
+			printWarning("Could not get relative path for %s: %v", path, err)
+			return nil
+		}
+
+		// Check if directory should be ignored (before entering it)
+		if d.IsDir() {
+			// Don't ignore the root directory itself, only subdirectories
+			if relPath == "." {
+				return loadAttributes(path, "", config)
+			}
+			if isExcludedDir(relPath, config) {
+				printVerbose(config, "Skipping directory %s: --exclude-dir %s", relPath, d.Name())
+				return filepath.SkipDir
+			}
+			if skipsHidden(relPath, true, config) {
+				printVerbose(config, "Skipping directory %s: hidden (--no-hidden)", relPath)
+				return filepath.SkipDir
+			}
+			if exceedsMaxDepth(relPath, config) {
+				printVerbose(config, "Skipping directory %s: deeper than --max-depth %d", relPath, config.MaxDepth)
+				return filepath.SkipDir
+			}
+			if exceedsRecursionLimit(relPath, config) {
+				printWarning("Directory nesting limit (%d) reached, skipping %s", config.MaxRecursion, relPath)
+				return filepath.SkipDir
+			}
+			if ignored, reason := explainIgnore(relPath, true, ignorePatterns, config); ignored {
+				negation, ok := findDeepNegation(relPath, ignorePatterns, config)
+				if !ok {
+					printVerbose(config, "Skipping directory %s: %s", relPath, reason)
+					return filepath.SkipDir // Skip this directory and its contents
+				}
+				// Files below stay ignored unless a negation matches them
+				printVerbose(config, "Entering ignored directory %s: %s may re-include files below it", relPath, negation)
+			}
+			if config.EmitEmptyDirs {
+				config.WalkedDirs = append(config.WalkedDirs, FileEntry{Path: path, RelPath: relPath, Root: absDir})
+			}
+			return loadAttributes(path, relPath, config) // Continue into this directory
+		}
+
+		if skipsHidden(relPath, false, config) {
+			printVerbose(config, "Skipping %s: hidden (--no-hidden)", relPath)
+			stats.skip(SkipIgnored)
+			return nil
+		}
+
+		// For files, process normally
+		return processDirectoryEntry(path, d, absDir, absOutput, ignorePatterns, &files, stats, config)
+	})
+	return files, err
+}
+
+// readPathList reads newline- or NUL-separated paths into a set of cleaned,
+// slash-separated relative paths
+func readPathList(r io.Reader, nullSeparated bool) (map[string]bool, error) {
+	separator := byte('\n')
+	if nullSeparated {
+		separator = 0
+	}
+
+	paths := make(map[string]bool)
+	reader := bufio.NewReader(r)
+	for {
+		entry, err := reader.ReadString(separator)
+		entry = strings.TrimSuffix(entry, string(separator))
+		if !nullSeparated {
+			entry = strings.TrimSuffix(entry, "\r")
+		}
+		if entry != "" {
+			paths[filepath.ToSlash(filepath.Clean(entry))] = true
+		}
+		if err == io.EOF {
+			return paths, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// matchesInclude reports whether the file matches an --include pattern (always true without any)
+func matchesInclude(relPath string, config *Config) bool {
+	if len(config.Include) == 0 {
+		return true
+	}
+	for _, include := range config.Include {
+		if matchPattern(filepath.ToSlash(relPath), filepath.ToSlash(include), false, config.IgnoreCase) {
+			return true
+		}
+	}
+	return false
+}
+
+// rebasePatterns converts CLI patterns written relative to the current directory
+// into patterns relative to the scanned directory. Only patterns containing a slash
+// are anchored; slash-less and **/ patterns match at any depth and are kept as is.
+// Patterns pointing outside the scanned directory can never match and are dropped.
+func rebasePatterns(patterns []string, directory string) []string {
+	absDir, err := filepath.Abs(directory)
+	if err != nil {
+		return patterns
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return patterns
+	}
+
+	var rebased []string
+	for _, pattern := range patterns {
+		negation := ""
+		if strings.HasPrefix(pattern, "!") {
+			negation = "!"
+			pattern = pattern[1:]
+		}
+
+		slashed := filepath.ToSlash(pattern)
+		if !strings.Contains(strings.TrimSuffix(slashed, "/"), "/") || strings.HasPrefix(slashed, "**/") {
+			rebased = append(rebased, negation+pattern)
+			continue
+		}
+
+		rel, err := filepath.Rel(absDir, filepath.Join(cwd, pattern))
+		if err != nil || rel == ".." || strings.HasPrefix(filepath.ToSlash(rel), "../") {
+			printWarning("Pattern %q is outside %s and is ignored", pattern, directory)
+			continue
+		}
+
+		rel = filepath.ToSlash(rel)
+		if strings.HasSuffix(slashed, "/") {
+			rel += "/"
+		}
+		rebased = append(rebased, negation+"/"+rel)
+	}
+	return rebased
+}
+
+// parseExtensions turns comma-separated extension lists into a set of ".ext" keys
+func parseExtensions(values []string) map[string]bool {
+	extensions := make(map[string]bool)
+	for _, value := range values {
+		for _, ext := range strings.Split(value, ",") {
+			ext = strings.TrimSpace(ext)
+			if ext == "" {
+				continue
+			}
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			extensions[ext] = true
+		}
+	}
+	return extensions
+}
+
+// Whether the command line matches extensions case-insensitively without
+// --ext-ignore-case; on where filesystems usually ignore case
+var defaultExtIgnoreCase = runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+
+// hasExtension reports whether the file's extension is in the set, ignoring case
+// if ignoreCase is set
+func hasExtension(relPath string, extensions map[string]bool, ignoreCase bool) bool {
+	ext := filepath.Ext(relPath)
+	if extensions[ext] {
+		return true
+	}
+	if !ignoreCase {
+		return false
+	}
+	for candidate := range extensions {
+		if strings.EqualFold(candidate, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcludedDir reports whether directory relDir has a name given to --exclude-dir
+func isExcludedDir(relDir string, config *Config) bool {
+	name := filepath.Base(relDir)
+	for _, excluded := range config.ExcludeDirs {
+		if name == excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// skipsHidden reports whether --no-hidden leaves out relPath: its name starts with a
+// dot and no --include pattern that names a hidden path matches it or, for a
+// directory, can match below it
+func skipsHidden(relPath string, isDir bool, config *Config) bool {
+	if !config.NoHidden || !strings.HasPrefix(filepath.Base(relPath), ".") {
+		return false
+	}
+	slashed := filepath.ToSlash(relPath)
+	for _, include := range config.Include {
+		include = filepath.ToSlash(include)
+		if !namesHiddenPath(include) {
+			continue
+		}
+		if matchPattern(slashed, include, isDir, config.IgnoreCase) {
+			return false
+		}
+		if isDir && patternReachesBelow(strings.Split(slashed, "/"), strings.Split(strings.TrimPrefix(include, "/"), "/"), config.IgnoreCase) {
+			return false
+		}
+	}
+	return true
+}
+
+// namesHiddenPath reports whether a pattern has a segment starting with a dot
+func namesHiddenPath(pattern string) bool {
+	for _, segment := range strings.Split(pattern, "/") {
+		if strings.HasPrefix(segment, ".") && segment != "." && segment != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// exceedsMaxDepth reports whether the files inside directory relDir are beyond --max-depth
+func exceedsMaxDepth(relDir string, config *Config) bool {
+	if config.MaxDepth < 0 {
+		return false
+	}
+	depth := strings.Count(filepath.ToSlash(relDir), "/") + 1
+	return depth > config.MaxDepth
+}
+
+// exceedsRecursionLimit reports whether directory relDir is nested deeper than --max-recursion
+func exceedsRecursionLimit(relDir string, config *Config) bool {
+	if config.MaxRecursion <= 0 {
+		return false
+	}
+	return strings.Count(filepath.ToSlash(relDir), "/")+1 > config.MaxRecursion
+}
+
+// orderFiles returns the files in emission order: files matching a --priority glob
+// first (in flag order), then everything else, each in --sort order. Name order is
+// the walk order.
+func orderFiles(files []FileEntry, config *Config) []FileEntry {
+	tagged := false
+	for _, file := range files {
+		tagged = tagged || file.Attributes[AttrPriority]
+	}
+	if len(config.Priority) == 0 && !tagged && !config.GroupByDir && (config.Sort == "" || config.Sort == "name") {
+		return files
+	}
+
+	rank := func(file FileEntry) int { return priorityRank(file, config) }
+
+	ordered := make([]FileEntry, len(files))
+	copy(ordered, files)
+	switch config.Sort {
+	case "size":
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return fileSize(ordered[i]) > fileSize(ordered[j])
+		})
+	case "mtime":
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return fileModTime(ordered[i]).After(fileModTime(ordered[j]))
+		})
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		// With --group-by-dir, root files come first, then one group per top-level directory
+		if config.GroupByDir {
+			a, b := topLevelDir(ordered[i].RelPath), topLevelDir(ordered[j].RelPath)
+			if a != b {
+				return a < b
+			}
+		}
+		return rank(ordered[i]) < rank(ordered[j])
+	})
+	return ordered
+}
+
+// pickFiles lists the files with numbers and lets the user toggle which ones to
+// keep, all of them being selected at first. An empty line or end of input confirms.
+func pickFiles(files []FileEntry, in io.Reader, out io.Writer) ([]FileEntry, error) {
+	selected := make([]bool, len(files))
+	for i := range selected {
+		selected[i] = true
+	}
+
+	reader := bufio.NewReader(in)
+	for {
+		for i, file := range files {
+			mark := " "
+			if selected[i] {
+				mark = "x"
+			}
+			fmt.Fprintf(out, "%4d [%s] %s\n", i+1, mark, file.RelPath)
+		}
+		fmt.Fprint(out, "Toggle files by number or range (e.g. 2 4-6), a = all, n = none, q = quit, empty line to write: ")
+
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			fmt.Fprintln(out)
+			break
+		}
+
+		switch answer {
+		case "a", "n":
+			for i := range selected {
+				selected[i] = answer == "a"
+			}
+		case "q":
+			return nil, fmt.Errorf("file selection cancelled")
+		default:
+			if err := toggleSelection(selected, answer); err != nil {
+				fmt.Fprintf(out, "%v\n", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	var picked []FileEntry
+	for i, file := range files {
+		if selected[i] {
+			picked = append(picked, file)
+		}
+	}
+	return picked, nil
+}
+
+// toggleSelection flips the entries named by a list of 1-based numbers and ranges
+func toggleSelection(selected []bool, answer string) error {
+	for _, field := range strings.FieldsFunc(answer, func(r rune) bool { return r == ' ' || r == ',' }) {
+		first, last, isRange := strings.Cut(field, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return fmt.Errorf("not a number: %s", field)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil {
+				return fmt.Errorf("not a number: %s", field)
+			}
+		}
+		if start < 1 || end > len(selected) || start > end {
+			return fmt.Errorf("out of range: %s", field)
+		}
+		for i := start; i <= end; i++ {
+			selected[i-1] = !selected[i-1]
+		}
+	}
+	return nil
+}
+
+// priorityRank returns the position of the first --priority glob matching the file,
+// followed by files with the priority attribute and then all others
+func priorityRank(file FileEntry, config *Config) int {
+	for i, glob := range config.Priority {
+		if matchPattern(filepath.ToSlash(file.RelPath), filepath.ToSlash(glob), false, config.IgnoreCase) {
+			return i
+		}
+	}
+	if file.Attributes[AttrPriority] {
+		return len(config.Priority)
+	}
+	return len(config.Priority) + 1
+}
+
+// selectWithinBudget keeps the files that fit in --max-tokens, choosing greedily by
+// priority, then size (smallest first), then path. The kept files stay in emission order.
+// written is the size of what the output already holds, such as the header.
+func selectWithinBudget(files []FileEntry, written int64, stats *Stats, config *Config) []FileEntry {
+	files = measureFiles(files, stats, config)
+
+	// The header and the end of the output are always written
+	budget := int64(config.MaxTokens) - estimateTokens(written+endCost(config))
+
+	candidates := make([]int, len(files))
+	for i := range candidates {
+		candidates[i] = i
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := files[candidates[i]], files[candidates[j]]
+		if rankA, rankB := priorityRank(a, config), priorityRank(b, config); rankA != rankB {
+			return rankA < rankB
+		}
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+		return a.RelPath < b.RelPath
+	})
+
+	keep := make([]bool, len(files))
+	seen := make(map[[sha256.Size]byte]string) // Content hash to the first kept path, for --dedup
+	groups := make(map[string]bool)            // --group-by-dir banners of the kept files
+	dropped := 0
+	for _, i := range candidates {
+		file := files[i]
+		sum := sha256.Sum256(file.content)
+		duplicateOf := ""
+		if config.Dedup && !file.Binary {
+			duplicateOf = seen[sum]
+		}
+		bytes := sectionCost(file.RelPath, file.content, file.Binary, duplicateOf, config)
+		group := ""
+		if config.GroupByDir {
+			relPath, _ := filepath.Rel(file.Root, file.Path)
+			if group = topLevelDir(relPath); group != "" && !groups[group] {
+				bytes += groupCost(group, config)
+			}
+		}
+		cost := estimateTokens(bytes)
+		if cost <= budget {
+			budget -= cost
+			keep[i] = true
+			if _, ok := seen[sum]; !ok {
+				seen[sum] = file.RelPath
+			}
+			groups[group] = true
+			continue
+		}
+		printVerbose(config, "Skipping %s: about %d tokens, only %d left within --max-tokens", files[i].RelPath, cost, budget)
+		stats.skip(SkipBudget)
+		dropped++
+	}
+	if dropped > 0 {
+		printWarning("Left out %d file(s) to stay within --max-tokens %d (use --verbose to list them)", dropped, config.MaxTokens)
+	}
+
+	var selected []FileEntry
+	for i, file := range files {
+		if keep[i] {
+			selected = append(selected, file)
+		}
+	}
+	return selected
+}
+
+// sectionCost returns the bytes the output format takes for a file section, or
+// with duplicateOf set for the --dedup reference to that earlier file
+func sectionCost(relPath string, content []byte, binary bool, duplicateOf string, config *Config) int64 {
+	return renderedSize(config.Formatter, func(f Formatter, w io.Writer) error {
+		switch {
+		case binary:
+			return f.WriteBinary(w, relPath, content)
+		case duplicateOf != "" && writesReferences(config.Formatter):
+			return f.WriteDuplicate(w, relPath, duplicateOf)
+		default:
+			return f.WriteFile(w, relPath, content)
+		}
+	})
+}
+
+// groupCost returns the bytes the output format takes for a --group-by-dir banner
+func groupCost(dir string, config *Config) int64 {
+	return renderedSize(config.Formatter, func(f Formatter, w io.Writer) error {
+		return f.WriteGroup(w, dir)
+	})
+}
+
+// endCost returns the bytes the output format takes to end the output, such as the
+// end marker or closing tags
+func endCost(config *Config) int64 {
+	return renderedSize(config.Formatter, func(f Formatter, w io.Writer) error {
+		return f.WriteEnd(w)
+	})
+}
+
+// fileSize returns the size of the file on disk, or 0 if unknown
+func fileSize(file FileEntry) int64 {
+	if file.Info == nil {
+		return 0
+	}
+	return file.Info.Size()
+}
+
+// fileModTime returns the modification time of the file, or the zero time if unknown
+func fileModTime(file FileEntry) time.Time {
+	if file.Info == nil {
+		return time.Time{}
+	}
+	return file.Info.ModTime()
+}
+
+// topLevelDir returns the first directory of relPath, or "" for files in the root
+func topLevelDir(relPath string) string {
+	dir, _, found := strings.Cut(filepath.ToSlash(relPath), "/")
+	if !found {
+		return ""
+	}
+	return dir
+}
+
+// measureFiles fills in the size, line count and binary flag of each file, dropping
+// files that can't be read or turn out to be left out. The content is kept with
+// the file, so it is read only once.
+func measureFiles(files []FileEntry, stats *Stats, config *Config) []FileEntry {
+	measured := files[:0]
+	for _, file := range files {
+		if file.measured {
+			measured = append(measured, file)
+			continue
+		}
+		content, binary, err := readWithRetries(file, config)
+		var skipped skipError
+		if errors.As(err, &skipped) {
+			printVerbose(config, "Skipping %s: %s", file.RelPath, skipped.message)
+			stats.skip(skipped.reason)
+			continue
+		}
+		if err != nil {
+			printWarning("Could not read %s: %v", file.Path, err)
+			continue
+		}
+		file.Binary = binary
+		file.Size = int64(len(content))
+		file.content = content
+		file.measured = true
+		if !file.Binary {
+			file.Lines = countLines(content)
+		}
+		measured = append(measured, file)
+	}
+	return measured
+}
+
+// noteSymlink records a skipped symlink for --note-symlinks, unless ignore rules leave it out
+func noteSymlink(path string, isDir bool, absDir string, ignorePatterns []IgnorePattern, config *Config) {
+	relPath, err := filepath.Rel(absDir, path)
+	if err != nil {
+		return
+	}
+	if ignored, _ := explainIgnore(relPath, isDir, ignorePatterns, config); ignored {
+		return
+	}
+	target, err := os.Readlink(path)
+	if err != nil {
+		printWarning("Could not read symlink %s: %v", path, err)
+		return
+	}
+	config.Symlinks = append(config.Symlinks, FileEntry{Path: path, RelPath: relPath, Root: absDir, LinkTarget: target})
+}
+
+// countLines counts lines, including a final line without a trailing newline
+func countLines(content []byte) int {
+	lines := strings.Count(string(content), "\n")
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		lines++
+	}
+	return lines
+}
+
+// processDirectoryEntry checks a single file entry and adds it to files if it should be included
+func processDirectoryEntry(path string, d fs.DirEntry, absDir, absOutput string, ignorePatterns []IgnorePattern, files *[]FileEntry, stats *Stats, config *Config) error {
+	// Skip if it's the output file itself
+	if absPath, _ := filepath.Abs(path); isOutputFile(absPath, absOutput, config) {
+		return nil
+	}
+
+	// Skip symlinks (but only if they're directories to avoid infinite loops)
+	if d.Type()&fs.ModeSymlink != 0 {
+		// Check if the symlink points to a directory
+		info, err := os.Stat(path)
+		// Skip broken links, and symlinked directories to avoid infinite loops
+		if err != nil || info.IsDir() {
+			if config.NoteSymlinks {
+				noteSymlink(path, err == nil, absDir, ignorePatterns, config)
+			}
+			return nil
+		}
+		// Allow symlinked files (common in config management)
+	}
+
+	// Get relative path
+	relPath, err := filepath.Rel(absDir, path)
+	if err != nil {
+		// This is unusual, but continue processing
+		printWarning("Could not get relative path for %s: %v", path, err)
+		return nil
+	}
+
+	// Check if file should be ignored
+	if ignored, reason := explainIgnore(relPath, false, ignorePatterns, config); ignored {
+		printVerbose(config, "Skipping %s: %s", relPath, reason)
+		stats.skip(SkipIgnored)
+		return nil
+	}
+
+	// Check the --stdin-list selection
+	if config.ListedFiles != nil && !config.ListedFiles[filepath.ToSlash(relPath)] {
+		printVerbose(config, "Skipping %s: not listed on stdin", relPath)
+		stats.skip(SkipIgnored)
+		return nil
+	}
+
+	// Check the --include allowlist
+	if !matchesInclude(relPath, config) {
+		printVerbose(config, "Skipping %s: not matched by any --include pattern", relPath)
+		stats.skip(SkipIgnored)
+		return nil
+	}
+
+	// Check the extension allowlist and denylist
+	if len(config.OnlyExts) > 0 && !hasExtension(relPath, config.OnlyExts, config.ExtIgnoreCase) {
+		printVerbose(config, "Skipping %s: extension not in --only-ext", relPath)
+		stats.skip(SkipIgnored)
+		return nil
+	}
+	if hasExtension(relPath, config.ExcludeExts, config.ExtIgnoreCase) {
+		printVerbose(config, "Skipping %s: excluded extension", relPath)
+		stats.skip(SkipIgnored)
+		return nil
+	}
+
+	attributes := fileAttributes(relPath, config)
+
+	// Check the size limit; oversized files are kept when they will be truncated
+	if config.MaxFileSize > 0 && config.TruncateLarge <= 0 && !attributes[AttrNeverTruncate] {
+		if info, err := os.Stat(path); err == nil && info.Size() > config.MaxFileSize {
+			printVerbose(config, "Skipping %s: larger than --max-file-size (%d bytes)", relPath, info.Size())
+			stats.skip(SkipOversized)
+			return nil
+		}
+	}
+
+	// Include file; whether it is binary is found out when it is read
+	entry := FileEntry{Path: path, RelPath: relPath, Attributes: attributes, Root: absDir}
+	if config.Sort == "size" || config.Sort == "mtime" {
+		entry.Info, _ = d.Info()
+	}
+	*files = append(*files, entry)
+	return nil
+}
+
+func loadIgnorePatterns(directory string, config *Config) ([]IgnorePattern, error) {
+	var patterns []IgnorePattern
+
+	// The directory should already be resolved by the caller
+	// But just to be safe, make it absolute if it isn't already
+	absDir := directory
+	if !filepath.IsAbs(directory) {
+		var err error
+		absDir, err = filepath.Abs(directory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The last applicable pattern decides, so the defaults go first to let any
+	// user pattern, including a negation, take precedence
+	if !config.NoDefaultExcludes {
+		patterns = append(patterns, defaultIgnorePatterns(config)...)
+	}
+	if config.ExcludeTestFiles {
+		for _, pattern := range testFilePatterns {
+			patterns = append(patterns, IgnorePattern{Pattern: pattern, Source: "--exclude-test-files"})
+		}
+	}
+	if config.ExcludeVendored {
+		for _, pattern := range vendoredPatterns {
+			patterns = append(patterns, IgnorePattern{Pattern: pattern, Source: "--exclude-vendored"})
+		}
+	}
+
+	// Load ignore patterns incrementally, respecting already-loaded patterns
+	err := loadIgnorePatternsRecursive(absDir, "", &patterns, config)
+	return patterns, err
+}
+
+// defaultIgnorePatterns returns the built-in patterns for noisy generated files,
+// all of which --no-default-excludes turns off
+func defaultIgnorePatterns(config *Config) []IgnorePattern {
+	if config.IncludeLockfiles {
+		return nil
+	}
+	patterns := make([]IgnorePattern, 0, len(lockfiles))
+	for _, name := range lockfiles {
+		patterns = append(patterns, IgnorePattern{
+			Pattern: "**/" + name,
+			Source:  "default lockfile list (use --include-lockfiles to keep it)",
+		})
+	}
+	return patterns
+}
+
+// ignoreFileNames returns the ignore files read by the built-in matcher
+func ignoreFileNames(config *Config) []string {
+	// When git decides ignores, only unfolder's own ignore files are left to us
+	if config.GitChecker != nil {
+		return []string{".unfolderignore"}
+	}
+	return []string{".gitignore", ".unfolderignore"}
+}
+
+// loadIgnorePatternsRecursive loads ignore patterns recursively, respecting already-loaded patterns
+func loadIgnorePatternsRecursive(absDir, relDir string, patterns *[]IgnorePattern, config *Config) error {
+	// Build current path
+	currentPath := absDir
+	if relDir != "" {
+		currentPath = filepath.Join(absDir, relDir)
+	}
+
+	// Don't look for ignore files in directories that won't be walked
+	if relDir != "" && (isExcludedDir(relDir, config) || skipsHidden(relDir, true, config) || exceedsMaxDepth(relDir, config) || exceedsRecursionLimit(relDir, config)) {
+		return nil
+	}
+
+	// Check if current directory should be ignored based on already-loaded patterns
+	if relDir != "" && prunesIgnoredDir(relDir, *patterns, config) {
+		return nil // Skip this directory entirely
+	}
+
+	// Read .gitignore and .unfolderignore files in current directory
+	for _, ignoreFile := range ignoreFileNames(config) {
+		ignorePath := filepath.Join(currentPath, ignoreFile)
+		if filePatterns, err := readIgnoreFileWithContext(ignorePath, relDir); err == nil {
+			*patterns = append(*patterns, filePatterns...)
+		}
+	}
+
+	// Extra --ignore-path files act as root-level ignore files, after the in-tree ones
+	if relDir == "" {
+		for _, ignorePath := range config.IgnorePaths {
+			filePatterns, err := readIgnoreFileWithContext(ignorePath, "")
+			if err != nil {
+				return fmt.Errorf("could not read ignore file %s: %v", ignorePath, err)
+			}
+			*patterns = append(*patterns, filePatterns...)
+		}
+
+		// --exclude patterns come last, as if appended to the root ignore file
+		for _, exclude := range config.Exclude {
+			*patterns = append(*patterns, IgnorePattern{
+				Pattern:   strings.TrimPrefix(exclude, "!"),
+				Dir:       "",
+				IsNegated: strings.HasPrefix(exclude, "!"),
+				Source:    "--exclude",
+			})
+		}
+	}
+
+	// Nested ignore files are not consulted in root-only mode
+	if config.RootIgnoreOnly {
+		return nil
+	}
+
+	// List directory contents
+	entries, err := os.ReadDir(currentPath)
+	if err != nil {
+		if os.IsPermission(err) {
+			printWarning("Permission denied accessing %s: %v", currentPath, err)
+			return nil
+		}
+		return err
+	}
+
+	// Process subdirectories
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		// Build relative path for subdirectory
+		subRelDir := entry.Name()
+		if relDir != "" {
+			subRelDir = filepath.Join(relDir, entry.Name())
+		}
+
+		// Skip VCS and ignored directories, matched by their full path so that
+		// anchored patterns only apply where they were written
+		if !prunesIgnoredDir(subRelDir, *patterns, config) {
+			// Recursively load patterns from subdirectory
+			if err := loadIgnorePatternsRecursive(absDir, subRelDir, patterns, config); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func readIgnoreFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		// Check if it's a permission error
+		if os.IsPermission(err) {
+			printWarning("Permission denied reading %s: %v", path, err)
+			return nil, nil // Return empty patterns, continue processing
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// Skip empty lines and comments
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+
+	return patterns, scanner.Err()
+}
+
+func readIgnoreFileWithContext(path, ignoreDir string) ([]IgnorePattern, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		// Check if it's a permission error
+		if os.IsPermission(err) {
+			printWarning("Permission denied reading %s: %v", path, err)
+			return nil, nil // Return empty patterns, continue processing
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []IgnorePattern
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := trimTrailingSpaces(strings.TrimSuffix(scanner.Text(), "\r"))
+		// Skip empty lines and comments; \# starts a pattern with a literal #
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		isNegated := strings.HasPrefix(line, "!")
+		pattern := strings.TrimPrefix(line, "!")
+		// Like git, a trailing backslash makes the pattern invalid
+		if pattern == "" || trailingBackslash(pattern) {
+			continue
+		}
+
+		patterns = append(patterns, IgnorePattern{
+			Pattern:   pattern,
+			Dir:       ignoreDir,
+			IsNegated: isNegated,
+			Source:    path,
+			Line:      lineNumber,
+		})
+	}
+
+	return patterns, scanner.Err()
+}
+
+// trimTrailingSpaces removes the spaces at the end of an ignore file line, except
+// those escaped with a backslash. As in git, leading spaces and tabs are kept.
+func trimTrailingSpaces(line string) string {
+	end := len(line)
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ':
+			if end == len(line) {
+				end = i
+			}
+		case '\\':
+			i++
+			fallthrough
+		default:
+			end = len(line)
+		}
+	}
+	return line[:end]
+}
+
+// trailingBackslash reports whether pattern ends in a backslash that escapes nothing
+func trailingBackslash(pattern string) bool {
+	escaped := false
+	for i := 0; i < len(pattern); i++ {
+		escaped = !escaped && pattern[i] == '\\'
+	}
+	return escaped
+}
+
+// loadAttributes reads the .unfolderattributes file of directory relDir, if any
+func loadAttributes(dirPath, relDir string, config *Config) error {
+	path := filepath.Join(dirPath, ".unfolderattributes")
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsPermission(err) {
+			printWarning("Permission denied reading %s: %v", path, err)
+		}
+		return nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		fields := strings.Fields(scanner.Text())
+		// Skip empty lines and comments
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		rule := AttributeRule{
+			Pattern:    IgnorePattern{Pattern: fields[0], Dir: relDir, Source: path, Line: lineNumber},
+			Attributes: make(map[string]bool),
+		}
+		for _, field := range fields[1:] {
+			// A leading - unsets an attribute set by an earlier line, as in .gitattributes
+			name := strings.TrimPrefix(field, "-")
+			if name != AttrPriority && name != AttrNeverTruncate {
+				printWarning("Unknown attribute %q in %s:%d", name, path, lineNumber)
+				continue
+			}
+			rule.Attributes[name] = !strings.HasPrefix(field, "-")
+		}
+		config.Attributes = append(config.Attributes, rule)
+	}
+	return scanner.Err()
+}
+
+// fileAttributes returns the attributes of a file; later rules override earlier ones
+func fileAttributes(relPath string, config *Config) map[string]bool {
+	var attributes map[string]bool
+	for _, rule := range config.Attributes {
+		if !isPatternApplicable(relPath, false, rule.Pattern, config.IgnoreCase) {
+			continue
+		}
+		if attributes == nil {
+			attributes = make(map[string]bool)
+		}
+		for name, set := range rule.Attributes {
+			attributes[name] = set
+		}
+	}
+	return attributes
+}
+
+func shouldIgnore(filePath string, isDir bool, patterns []IgnorePattern, config *Config) bool {
+	ignored, _ := explainIgnore(filePath, isDir, patterns, config)
+	return ignored
+}
+
+// explainIgnore decides whether a path is ignored and describes the rule that decided it.
+// isDir tells whether the path is a directory, which patterns ending in / require.
+func explainIgnore(filePath string, isDir bool, patterns []IgnorePattern, config *Config) (bool, string) {
+	// Check VCS directories first (unless explicitly included)
+	if !config.IncludeVCSDirectories {
+		for _, vcsDir := range vcsDirectories {
+			// Check if the path contains a VCS directory anywhere in the path
+			// This handles cases like "baserow/.git/HEAD" or "project/.svn/entries"
+			pathParts := strings.Split(filepath.ToSlash(filePath), "/")
+			for _, part := range pathParts {
+				if part == strings.TrimSuffix(vcsDir, "/") {
+					// A negation such as !.git/config still brings single files back
+					if negation, ok := findVCSNegation(filePath, isDir, patterns, config.IgnoreCase); ok {
+						return false, "re-included by " + negation.String()
+					}
+					return true, fmt.Sprintf("VCS directory %s (use --include-vcs to keep it)", vcsDir)
+				}
+			}
+		}
+	}
+
+	// In git parity mode, git has the final say on .gitignore rules
+	if config.GitChecker != nil {
+		if ignored, reason := config.GitChecker.Check(filePath); ignored {
+			return true, reason
+		}
+	}
+
+	// Check user-defined patterns with Git-like behavior
+	// Each .gitignore affects its own directory and sub-directories
+	if pattern, ok := lastApplicablePattern(filePath, isDir, patterns, config.IgnoreCase); ok {
+		if pattern.IsNegated {
+			// Negated patterns override previous ignore decisions
+			return false, "re-included by " + pattern.String()
+		}
+		return true, pattern.String()
+	}
+	return false, ""
+}
+
+// lastApplicablePattern returns the pattern that decides filePath. As in git, the
+// last applicable one wins: patterns are in load order, so a later line beats an
+// earlier one and a nested ignore file beats the ones above it.
+func lastApplicablePattern(filePath string, isDir bool, patterns []IgnorePattern, ignoreCase bool) (IgnorePattern, bool) {
+	for i := len(patterns) - 1; i >= 0; i-- {
+		if isPatternApplicable(filePath, isDir, patterns[i], ignoreCase) {
+			return patterns[i], true
+		}
+	}
+	return IgnorePattern{}, false
+}
+
+// findVCSNegation returns the negated pattern that re-includes filePath inside a
+// VCS directory. For a directory, a negation naming a path below it also counts,
+// so the walk descends far enough to reach the re-included file.
+func findVCSNegation(filePath string, isDir bool, patterns []IgnorePattern, ignoreCase bool) (IgnorePattern, bool) {
+	filePath = filepath.ToSlash(filePath)
+	if pattern, ok := lastApplicablePattern(filePath, isDir, patterns, ignoreCase); ok && pattern.IsNegated {
+		return pattern, true
+	}
+
+	for _, pattern := range patterns {
+		if !pattern.IsNegated {
+			continue
+		}
+		target := path.Join(filepath.ToSlash(pattern.Dir), strings.TrimPrefix(filepath.ToSlash(pattern.Pattern), "/"))
+		if strings.HasPrefix(target, filePath+"/") {
+			return pattern, true
+		}
+	}
+	return IgnorePattern{}, false
+}
+
+// prunesIgnoredDir reports whether the walk skips dir because it is ignored. With
+// --deep-negation it still enters an ignored directory a negation reaches into.
+func prunesIgnoredDir(dir string, patterns []IgnorePattern, config *Config) bool {
+	if !shouldIgnore(dir, true, patterns, config) {
+		return false
+	}
+	_, enter := findDeepNegation(dir, patterns, config)
+	return !enter
+}
+
+// findDeepNegation returns a negated pattern that, with --deep-negation, can
+// re-include paths below the ignored directory dir. Only negations with a slash
+// count, matched segment by segment; a ** segment reaches any depth.
+func findDeepNegation(dir string, patterns []IgnorePattern, config *Config) (IgnorePattern, bool) {
+	if !config.DeepNegation {
+		return IgnorePattern{}, false
+	}
+	dirSegments := strings.Split(filepath.ToSlash(dir), "/")
+	for i := len(patterns) - 1; i >= 0; i-- {
+		pattern := patterns[i]
+		text := strings.TrimSuffix(filepath.ToSlash(pattern.Pattern), "/")
+		if !pattern.IsNegated || !strings.Contains(text, "/") {
+			continue
+		}
+		target := path.Join(filepath.ToSlash(pattern.Dir), strings.TrimPrefix(text, "/"))
+		if patternReachesBelow(dirSegments, strings.Split(target, "/"), config.IgnoreCase) {
+			return pattern, true
+		}
+	}
+	return IgnorePattern{}, false
+}
+
+// patternReachesBelow reports whether a pattern can match a path strictly below
+// the directory, comparing the directory with the pattern's leading segments
+func patternReachesBelow(dirSegments, patternSegments []string, ignoreCase bool) bool {
+	for i, segment := range dirSegments {
+		if i < len(patternSegments) && patternSegments[i] == "**" {
+			return true
+		}
+		if i >= len(patternSegments)-1 {
+			return false
+		}
+		patternSegment := patternSegments[i]
+		if ignoreCase {
+			segment = strings.ToLower(segment)
+			patternSegment = strings.ToLower(patternSegment)
+		}
+		if !matchWildcardPattern(segment, patternSegment) {
+			return false
+		}
+	}
+	return true
+}
+
+// Explain reports whether path (relative to directory) would be skipped by the
+// ignore rules in effect for directory, and which rule made the decision
+func Explain(directory, path string, config *Config) (bool, string, error) {
+	absDir, err := filepath.Abs(directory)
+	if err != nil {
+		return false, "", err
+	}
+	resolvedDir, err := filepath.EvalSymlinks(absDir)
+	if err != nil {
+		return false, "", err
+	}
+
+	patterns, err := loadIgnorePatterns(resolvedDir, config)
+	if err != nil {
+		return false, "", err
+	}
+
+	// As in git, nothing below an ignored directory can be re-included. The walk
+	// never enters such a directory, so only an explicit query needs this check.
+	// --deep-negation is the exception: the walk enters directories a negation reaches into.
+	path = filepath.Clean(path)
+	for dir := filepath.Dir(path); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if ignored, reason := explainIgnore(dir, true, patterns, config); ignored {
+			if _, ok := findDeepNegation(dir, patterns, config); ok {
+				continue
+			}
+			return true, fmt.Sprintf("parent directory %s is ignored by %s", filepath.ToSlash(dir), reason), nil
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(resolvedDir, path))
+	isDir := err == nil && info.IsDir()
+	ignored, reason := explainIgnore(path, isDir, patterns, config)
+	if reason == "" {
+		reason = "no rule matches"
+	}
+	return ignored, reason, nil
+}
+
+// gitIgnoreChecker answers ignore queries through a long-running `git check-ignore`
+type gitIgnoreChecker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	failed bool
+}
+
+// newGitIgnoreChecker starts `git check-ignore` for the work tree containing dir
+func newGitIgnoreChecker(dir string) (*gitIgnoreChecker, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git binary not found")
+	}
+
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--is-inside-work-tree").Output()
+	if err != nil || strings.TrimSpace(string(out)) != "true" {
+		return nil, fmt.Errorf("%s is not inside a git work tree", dir)
+	}
+
+	cmd := exec.Command("git", "check-ignore", "--stdin", "-z", "--verbose", "--non-matching")
+	cmd.Dir = dir
+	// Make git flush its answer after every path so queries don't block
+	cmd.Env = append(os.Environ(), "GIT_FLUSH=1")
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &gitIgnoreChecker{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// Check reports whether git ignores the path (relative to the scanned directory)
+// and, if so, which rule is responsible
+func (g *gitIgnoreChecker) Check(relPath string) (bool, string) {
+	if g.failed {
+		return false, ""
+	}
+
+	if _, err := fmt.Fprintf(g.stdin, "%s\x00", filepath.ToSlash(relPath)); err != nil {
+		g.fail(err)
+		return false, ""
+	}
+
+	// Verbose output is four NUL-terminated fields: source, line number, pattern, path
+	var fields [4]string
+	for i := range fields {
+		field, err := g.stdout.ReadString(0)
+		if err != nil {
+			g.fail(err)
+			return false, ""
+		}
+		fields[i] = strings.TrimSuffix(field, "\x00")
+	}
+
+	// A matching negated pattern means the path is explicitly not ignored
+	source, line, pattern := fields[0], fields[1], fields[2]
+	if pattern == "" || strings.HasPrefix(pattern, "!") {
+		return false, ""
+	}
+	return true, fmt.Sprintf("git pattern %q from %s:%s", pattern, source, line)
+}
+
+// fail disables the checker after a communication error with git
+func (g *gitIgnoreChecker) fail(err error) {
+	g.failed = true
+	printWarning("git check-ignore failed, no longer consulting git: %v", err)
+}
+
+// Close stops the git process
+func (g *gitIgnoreChecker) Close() error {
+	g.stdin.Close()
+	return g.cmd.Wait()
+}
+
+// isPatternApplicable checks if a pattern from a specific directory applies to the given file path
+func isPatternApplicable(filePath string, isDir bool, pattern IgnorePattern, ignoreCase bool) bool {
+	// Convert paths to forward slashes for consistent matching
+	filePath = filepath.ToSlash(filePath)
+	patternDir := filepath.ToSlash(pattern.Dir)
+	patternText := filepath.ToSlash(pattern.Pattern)
+
+	// A negation re-includes only the paths it matches itself: unlike an ignore
+	// pattern, matching a parent directory does not carry over to what is below it,
+	// so with * and !*/ the files inside a directory stay ignored
+	match := matchPattern
+	if pattern.IsNegated {
+		match = matchOwnPath
+	}
+
+	// If the pattern is from the root directory (empty dir), it applies to all files
+	if patternDir == "" {
+		return match(filePath, patternText, isDir, ignoreCase)
+	}
+
+	// Check if the file path is within the directory where this pattern was defined
+	// or in a subdirectory of that directory
+	relPath, ok := strings.CutPrefix(filePath, patternDir)
+	if !ok || relPath != "" && relPath[0] != '/' {
+		return false
+	}
+
+	// For patterns defined in a subdirectory, the pattern matches the relative
+	// path from that directory
+	if relPath == "" {
+		relPath = filePath
+	}
+	return match(strings.TrimPrefix(relPath, "/"), patternText, isDir, ignoreCase)
+}
+
+// Enhanced pattern matching for gitignore patterns. isDir tells whether filePath is
+// a directory: a pattern ending in / only matches directories and what is below them.
+// Case matters unless ignoreCase is set, as in git.
+func matchPattern(filePath, pattern string, isDir, ignoreCase bool) bool {
+	return matchPathOrParents(filePath, pattern, isDir, ignoreCase, true)
+}
+
+// matchOwnPath is matchPattern without the parent directories: the pattern has to
+// match filePath itself
+func matchOwnPath(filePath, pattern string, isDir, ignoreCase bool) bool {
+	return matchPathOrParents(filePath, pattern, isDir, ignoreCase, false)
+}
+
+// matchPathOrParents matches filePath against a pattern and, if parents is set,
+// each of its parent directories
+func matchPathOrParents(filePath, pattern string, isDir, ignoreCase, parents bool) bool {
+	// A slash at the start or in the middle ties the pattern to the full path
+	anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+
+	// Remove leading slash
+	pattern = strings.TrimPrefix(pattern, "/")
+	filePath = strings.TrimPrefix(filePath, "/")
+
+	if ignoreCase {
+		filePath = strings.ToLower(filePath)
+		pattern = strings.ToLower(pattern)
+	}
+
+	// Convert to forward slashes for consistent matching
+	filePath = filepath.ToSlash(filePath)
+	pattern = filepath.ToSlash(pattern)
+
+	// Handle negation (patterns starting with !)
+	if strings.HasPrefix(pattern, "!") {
+		return false // Negation not supported in this context
+	}
+
+	// Directory pattern (ends with /) only matches the directory itself, but like
+	// any pattern also everything below a matching directory
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	if (isDir || !dirOnly) && matchSinglePath(filePath, pattern, anchored) {
+		return true
+	}
+	if !parents {
+		return false
+	}
+	for i := strings.LastIndexByte(filePath, '/'); i > 0; i = strings.LastIndexByte(filePath[:i], '/') {
+		if matchSinglePath(filePath[:i], pattern, anchored) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSinglePath matches one path against a pattern without looking at its parent
+// directories. As in gitignore, a slash-less pattern such as config.json or *.go is
+// matched against the last path component, at any depth; wildcards never match a /.
+func matchSinglePath(filePath, pattern string, anchored bool) bool {
+	// Handle double asterisk segments (**/x, a/**/b, x/**)
+	if hasDoubleAsterisk(pattern) {
+		return matchDoubleAsterisk(filePath, pattern)
+	}
+
+	if !anchored {
+		filePath = path.Base(filePath)
+	}
+
+	// Exact match
+	if pattern == filePath {
+		return true
+	}
+
+	// Enhanced wildcard patterns, and patterns with escaped characters
+	if strings.ContainsAny(pattern, "*?[\\") {
+		return enhancedWildcardMatch(filePath, pattern)
+	}
+	return false
+}
+
+// hasDoubleAsterisk reports whether any segment of the pattern is **
+func hasDoubleAsterisk(pattern string) bool {
+	if !strings.Contains(pattern, "**") {
+		return false
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == "**" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDoubleAsterisk matches a pattern with any number of ** segments, each
+// standing for zero or more path components
+func matchDoubleAsterisk(filePath, pattern string) bool {
+	// Most paths already differ in a literal last segment, so check it before splitting
+	last := pattern[strings.LastIndexByte(pattern, '/')+1:]
+	if !strings.ContainsAny(last, "*?[\\") && last != filePath[strings.LastIndexByte(filePath, '/')+1:] {
+		return false
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(pattern, "/") {
+		// Consecutive ** segments match the same as a single one
+		if segment == "**" && len(segments) > 0 && segments[len(segments)-1] == "**" {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return matchSegments(strings.Split(filePath, "/"), segments)
+}
+
+// matchSegments matches path components against pattern segments
+func matchSegments(components, segments []string) bool {
+	if len(segments) == 0 {
+		return len(components) == 0
+	}
+	if segments[0] == "**" {
+		for i := 0; i <= len(components); i++ {
+			if matchSegments(components[i:], segments[1:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(components) == 0 || !matchWildcardPattern(components[0], segments[0]) {
+		return false
+	}
+	return matchSegments(components[1:], segments[1:])
+}
+
+// enhancedWildcardMatch handles *, ?, and character classes
+func enhancedWildcardMatch(text, pattern string) bool {
+	// Convert pattern to regex-like matching
+	return matchWildcardPattern(text, pattern)
+}
+
+// matchWildcardPattern implements enhanced wildcard matching
+func matchWildcardPattern(text, pattern string) bool {
+	// Handle simple cases first
+	if pattern == "*" {
+		return !strings.Contains(text, "/")
+	}
+	if pattern == "?" {
+		return len(text) == 1 && text != "/"
+	}
+
+	// Convert pattern to regex-like matching
+	return matchPatternRecursive(text, pattern)
+}
+
+// matchPatternRecursive recursively matches pattern against text
+func matchPatternRecursive(text, pattern string) bool {
+	// Base cases
+	if pattern == "" {
+		return text == ""
+	}
+	if text == "" {
+		return pattern == "" || pattern == "*"
+	}
+
+	// Handle different pattern characters
+	switch pattern[0] {
+	case '*':
+		// * can match zero or more characters, but never crosses a /
+		if len(pattern) == 1 {
+			return !strings.Contains(text, "/") // * at end matches the rest of the component
+		}
+		// Try matching * with 0, 1, 2, ... characters
+		for i := 0; i <= len(text); i++ {
+			if matchPatternRecursive(text[i:], pattern[1:]) {
+				return true
+			}
+			if i < len(text) && text[i] == '/' {
+				break
+			}
+		}
+		return false
+
+	case '?':
+		// ? matches exactly one character other than /
+		if text[0] == '/' {
+			return false
+		}
+		return matchPatternRecursive(text[1:], pattern[1:])
+
+	case '[':
+		// Character class
+		end := strings.Index(pattern, "]")
+		if end == -1 {
+			return false // Malformed character class
+		}
+		charClass := pattern[1:end]
+		remainingPattern := pattern[end+1:]
+
+		// Check if current character matches the class
+		if len(text) == 0 || text[0] == '/' {
+			return false
+		}
+		if !matchCharacterClass(text[0], charClass) {
+			return false
+		}
+		return matchPatternRecursive(text[1:], remainingPattern)
+
+	case '\\':
+		// A backslash makes the next character literal, e.g. \*, \# or \!
+		if len(pattern) == 1 || text[0] != pattern[1] {
+			return false
+		}
+		return matchPatternRecursive(text[1:], pattern[2:])
+
+	default:
+		// Literal character
+		if text[0] != pattern[0] {
+			return false
+		}
+		return matchPatternRecursive(text[1:], pattern[1:])
+	}
+}
+
+// matchCharacterClass checks if a character matches a character class
+func matchCharacterClass(c byte, charClass string) bool {
+	if len(charClass) == 0 {
+		return false
+	}
+
+	// Handle negation
+	negated := false
+	if charClass[0] == '!' {
+		negated = true
+		charClass = charClass[1:]
+	}
+
+	// Handle ranges like a-z
+	for i := 0; i < len(charClass); i++ {
+		if i+2 < len(charClass) && charClass[i+1] == '-' {
+			start := charClass[i]
+			end := charClass[i+2]
+			if c >= start && c <= end {
+				return !negated
+			}
+			i += 2 // Skip the range
+		} else {
+			if c == charClass[i] {
+				return !negated
+			}
+		}
+	}
+
+	return negated
+}
+
+// sniffBinary reads the first sniffBytes bytes of r, a file of the given size (all
+// of it if sniffBytes is negative), and reports whether they contain a null byte.
+// An empty file counts as text. The bytes read are returned so reading can go on
+// from the same handle.
+func sniffBinary(r io.Reader, sniffBytes int, size int64) ([]byte, bool, error) {
+	if sniffBytes == 0 {
+		sniffBytes = DefaultSniffBytes
+	}
+	if sniffBytes > 0 {
+		// Only what the file holds is read, however large sniffBytes is
+		r = io.LimitReader(r, min(int64(sniffBytes), size))
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	return content, bytes.IndexByte(content, 0) >= 0, nil
+}
+
+// skipError reports a file that turned out, once read, to be left out
+type skipError struct {
+	reason  SkipReason
+	message string
+}
+
+func (e skipError) Error() string { return e.message }
+
+func processFile(file FileEntry, output *outputWriter, config *Config, state *writeState) error {
+	path, relPath := file.Path, file.RelPath
+	if config.MaxFiles > 0 && state.stats.Files >= config.MaxFiles {
+		printVerbose(config, "Skipping %s: --max-files %d reached", relPath, config.MaxFiles)
+		state.capped++
+		state.stats.skip(SkipMaxFiles)
+		return nil
+	}
+	// Once a file didn't fit, the rest are left out too, so earlier files are the ones kept
+	if state.full {
+		dropForTotalSize(relPath, state)
+		return nil
+	}
+	content, binary, err := file.content, file.Binary, error(nil)
+	if !file.measured {
+		content, binary, err = readWithRetries(file, config)
+	}
+	var skipped skipError
+	if errors.As(err, &skipped) {
+		printVerbose(config, "Skipping %s: %s", relPath, skipped.message)
+		state.stats.skip(skipped.reason)
+		return nil
+	}
+	if err != nil {
+		// A timeout or interrupt during a retry ends the run, whatever --on-error says
+		if stoppedEarly(err) {
+			return err
+		}
+		// Check if it's a permission error
+		if os.IsPermission(err) {
+			printWarning("Permission denied reading %s: %v", path, err)
+			state.stats.skip(SkipPermission)
+			return nil // Skip this file, continue processing
+		}
+		return handleReadError(path, err, state.stats, config)
+	}
+
+	if config.MaxTotalSize > 0 {
+		duplicateOf := ""
+		if config.Dedup && !binary {
+			duplicateOf = state.seen[sha256.Sum256(content)]
+		}
+		// The section comes with the --group-by-dir banner waiting for it
+		cost := sectionCost(relPath, content, binary, duplicateOf, config)
+		if state.group != "" {
+			cost += groupCost(state.group, config)
+		}
+		if !state.fits(cost, config) {
+			state.full = true
+			dropForTotalSize(relPath, state)
+			return nil
+		}
+	}
+	if binary {
+		return writeBinarySection(relPath, content, output, config, state)
+	}
+	return writeSection(relPath, content, output, config, state)
+}
+
+// fits reports whether cost more bytes keep the output within --max-total-size,
+// counting them if so. Costs are measured by the formatter before writing, since
+// formatters that hold sections until the end don't move the output offset.
+func (s *writeState) fits(cost int64, config *Config) bool {
+	if config.MaxTotalSize > 0 && s.outputBytes+cost > config.MaxTotalSize {
+		return false
+	}
+	s.outputBytes += cost
+	return true
+}
+
+// writeWithinTotalSize writes a section that doesn't hold a file's content, such as
+// an empty directory, leaving it out if it doesn't fit in --max-total-size
+func writeWithinTotalSize(relPath string, output *outputWriter, config *Config, state *writeState, write func(Formatter, io.Writer) error) error {
+	if config.MaxTotalSize > 0 && !state.fits(renderedSize(config.Formatter, write), config) {
+		dropForTotalSize(relPath, state)
+		return nil
+	}
+	return write(config.Formatter, output)
+}
+
+// dropForTotalSize leaves a file out to stay within --max-total-size
+func dropForTotalSize(relPath string, state *writeState) {
+	state.dropped = append(state.dropped, relPath)
+	state.stats.skip(SkipTotalSize)
+}
+
+// writePendingGroup writes the --group-by-dir banner waiting for its first section
+func writePendingGroup(output *outputWriter, config *Config, state *writeState) error {
+	if state.group == "" {
+		return nil
+	}
+	dir := state.group
+	state.group = ""
+	return config.Formatter.WriteGroup(output, dir)
+}
+
+// writeBinarySection writes a binary file base64-encoded
+func writeBinarySection(relPath string, content []byte, output *outputWriter, config *Config, state *writeState) error {
+	if err := writePendingGroup(output, config, state); err != nil {
+		return err
+	}
+	offset := output.Offset() + sectionSpacing(config.Formatter)
+	if err := config.Formatter.WriteBinary(output, relPath, content); err != nil {
+		return err
+	}
+	state.stats.add(relPath, int64(len(content)))
+
+	if config.Index {
+		sum := sha256.Sum256(content)
+		state.index = append(state.index, IndexEntry{
+			Path:   relPath,
+			Offset: offset,
+			Length: output.Offset() - offset,
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	return nil
+}
+
+// sectionSpacing returns the number of blank lines the output format writes before
+// each section, which the index leaves out of the section
+func sectionSpacing(formatter Formatter) int64 {
+	if tee, ok := formatter.(*teeFormatter); ok {
+		formatter = tee.Formatter
+	}
+	if text, ok := formatter.(textFormatter); ok {
+		return int64(text.sectionSpacing)
+	}
+	return 0
+}
+
+// writeSection writes one file section, or a reference to an identical earlier file
+func writeSection(relPath string, content []byte, output *outputWriter, config *Config, state *writeState) error {
+	// A marker line inside a file would end its section early for anyone parsing the text format
+	if text, ok := findTextFormatter(config.Formatter); ok {
+		if marker := findMarkerLine(content, !text.noEndMarker); marker != "" {
+			if config.Strict {
+				return fmt.Errorf("%s contains a %s line", relPath, marker)
+			}
+			printWarning("%s contains a %s line; readers of the output may take it for a section boundary", relPath, marker)
+		}
+	}
+	if err := writePendingGroup(output, config, state); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+
+	// Remember where the section starts for the index, after any blank lines before it
+	offset := output.Offset() + sectionSpacing(config.Formatter)
+
+	var err error
+	if original, ok := state.seen[sum]; ok && config.Dedup {
+		// Reference earlier identical content instead of repeating it
+		err = config.Formatter.WriteDuplicate(output, relPath, original)
+		state.stats.add(relPath, 0)
+	} else {
+		state.seen[sum] = relPath
+		err = config.Formatter.WriteFile(output, relPath, content)
+		state.stats.add(relPath, int64(len(content)))
+	}
+	if err != nil {
+		return err
+	}
+
+	if config.Index {
+		state.index = append(state.index, IndexEntry{
+			Path:   relPath,
+			Offset: offset,
+			Length: output.Offset() - offset,
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	return nil
+}
+
+// handleReadError applies --on-error to a file or directory that could not be read:
+// with skip the error is reported as a warning and the run continues, otherwise it is returned
+func handleReadError(path string, err error, stats *Stats, config *Config) error {
+	if config.OnError != "skip" {
+		return err
+	}
+	printWarning("Could not read %s, skipping it: %v", path, err)
+	stats.skip(SkipError)
+	return nil
+}
+
+// findMarkerLine returns the first line of content that equals the section divider
+// or, if withEnd is set, the end marker, or "" if there is none
+func findMarkerLine(content []byte, withEnd bool) string {
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == SectionDivider || withEnd && line == EndMarker {
+			return line
+		}
+	}
+	return ""
+}
+
+// indexPath derives the --index file name from the output path (repo.txt -> repo.index.json)
+func indexPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".index.json"
+}
+
+// writeIndex writes the index of file sections as JSON
+func writeIndex(path, outputPath string, entries []IndexEntry) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if entries == nil {
+		entries = []IndexEntry{}
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		Output string       `json:"output"`
+		Files  []IndexEntry `json:"files"`
+	}{filepath.Base(outputPath), entries})
+}
+
+// readFileContent reads a file as it will be written: truncated if it is over
+// --max-file-size with --truncate-large set, and with content transforms applied.
+// The file is opened once; its start is sniffed for null bytes and reading goes on
+// from the same handle. It reports whether the file is binary, and returns a
+// skipError for binaries that are left out.
+func readFileContent(file FileEntry, config *Config) ([]byte, bool, error) {
+	handle, err := os.Open(file.Path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer handle.Close()
+
+	info, err := handle.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	prefix, binary, err := sniffBinary(handle, config.BinarySniffBytes, info.Size())
+	if err != nil {
+		return nil, false, err
+	}
+	oversized := config.MaxFileSize > 0 && info.Size() > config.MaxFileSize && !file.Attributes[AttrNeverTruncate]
+
+	if binary {
+		if !config.IncludeBinary {
+			return nil, true, skipError{SkipBinary, "binary file"}
+		}
+		// Binaries can't be truncated, so --max-file-size always applies to them
+		if oversized {
+			return nil, true, skipError{SkipOversized, fmt.Sprintf("binary file larger than --max-file-size (%d bytes)", info.Size())}
+		}
+		// Binary content is written as is, without truncation or text transforms
+		content, err := readRest(handle, prefix, info.Size())
+		return content, true, err
+	}
+
+	if oversized && config.TruncateLarge > 0 {
+		// Minified files are recognized by their first bytes, before any truncation
+		if config.ExcludeMinified && looksMinified(prefix, info.Size()) {
+			return nil, false, skipError{SkipMinified, "minified"}
+		}
+		content, err := readHead(io.MultiReader(bytes.NewReader(prefix), handle), config.TruncateLarge, config.AnnotateTruncation)
+		if err != nil {
+			return nil, false, err
+		}
+		return transformContent(file.RelPath, content, config), false, nil
+	}
+
+	content, err := readRest(handle, prefix, info.Size())
+	if err != nil {
+		return nil, false, err
+	}
+	if config.ExcludeMinified && looksMinified(content, int64(len(content))) {
+		return nil, false, skipError{SkipMinified, fmt.Sprintf("minified (average line length %d)", averageLineLength(content))}
+	}
+	return transformContent(file.RelPath, content, config), false, nil
+}
+
+// looksMinified reports whether text of the given total size, of which content is
+// all or a leading part, is likely minified: bundlers join code into a few very long
+// lines, so the average line length is far above that of hand-written code
+func looksMinified(content []byte, size int64) bool {
+	return size >= MinifiedMinBytes && averageLineLength(content) >= MinifiedLineLength
+}
+
+// averageLineLength returns the average length of the lines of content in bytes
+func averageLineLength(content []byte) int {
+	lines := bytes.Count(content, []byte("\n"))
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		lines++
+	}
+	return len(content) / max(lines, 1)
+}
+
+// readRest reads the rest of a file after the prefix already read from it into a
+// buffer sized from the file's length, taking as few reads as os.ReadFile
+func readRest(handle *os.File, prefix []byte, size int64) ([]byte, error) {
+	// One extra byte lets the last read see EOF
+	capacity := int(size) + 1
+	if capacity < len(prefix)+512 {
+		capacity = len(prefix) + 512
+	}
+	content := make([]byte, len(prefix), capacity)
+	copy(content, prefix)
+	for {
+		if len(content) == cap(content) {
+			// The file grew since it was measured
+			content = append(content, 0)[:len(content)]
+		}
+		n, err := handle.Read(content[len(content):cap(content)])
+		content = content[:len(content)+n]
+		if err == io.EOF {
+			return content, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readWithRetries reads a file, retrying with exponential backoff while the read
+// fails with a transient error
+func readWithRetries(file FileEntry, config *Config) ([]byte, bool, error) {
+	delay := ReadRetryDelay
+	for attempt := 0; ; attempt++ {
+		content, binary, err := readFileContent(file, config)
+		if err == nil || attempt >= config.ReadRetries || !isTransientError(err) {
+			return content, binary, err
+		}
+		printVerbose(config, "Retrying %s in %v: %v", file.RelPath, delay, err)
+		if err := sleepContext(config, delay); err != nil {
+			return nil, false, err
+		}
+		delay *= 2
+	}
+}
+
+// sleepContext waits for delay, returning early with the context's error when a
+// timeout or interrupt ends the run first
+func sleepContext(config *Config, delay time.Duration) error {
+	if config.Context == nil {
+		time.Sleep(delay)
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-config.Context.Done():
+		return config.Context.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isTransientError reports whether a read error may go away when retried, as
+// happens on network file systems. Missing files and permission errors are permanent.
+func isTransientError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.EAGAIN, syscall.EINTR, syscall.ETIMEDOUT} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// readHead reads the first n lines of a file and appends a notice with the number
+// of lines left out, as an annotation if requested. The rest of the file is streamed,
+// never held in memory.
+func readHead(r io.Reader, n int, annotate bool) ([]byte, error) {
+	reader := bufio.NewReader(r)
+	var head []byte
+	for i := 0; i < n; i++ {
+		line, err := reader.ReadBytes('\n')
+		head = append(head, line...)
+		if err == io.EOF {
+			return head, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Count the remaining lines, including a final line without a newline
+	remaining := 0
+	pending := false
+	buffer := make([]byte, 32*1024)
+	for {
+		count, err := reader.Read(buffer)
+		for _, b := range buffer[:count] {
+			if b == '\n' {
+				remaining++
+				pending = false
+			} else {
+				pending = true
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pending {
+		remaining++
+	}
+
+	if remaining > 0 && annotate {
+		head = append(head, annotation(fmt.Sprintf("truncated %d lines", remaining))+"\n"...)
+	} else if remaining > 0 {
+		head = append(head, fmt.Sprintf("... (truncated, %d more lines)\n", remaining)...)
+	}
+	return head, nil
+}
+
+// annotation formats a line marking content that unfolder changed, such as
+// "[unfolder: truncated 120 lines]"
+func annotation(text string) string {
+	return AnnotationPrefix + text + AnnotationSuffix
+}
+
+// parseSize parses a byte size such as 1024, 500KB or 2MB (binary multiples)
+func parseSize(value string) (int64, error) {
+	text := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	} {
+		if strings.HasSuffix(text, unit.suffix) {
+			text = strings.TrimSpace(strings.TrimSuffix(text, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	var number int64
+	if _, err := fmt.Sscanf(text, "%d", &number); err != nil || number < 0 || fmt.Sprint(number) != text {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	if number > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return number * multiplier, nil
+}
+
+// Transformer rewrites the content of a text file before it is written. Transform
+// returns the new content and whether anything was changed.
+type Transformer interface {
+	Transform(path string, content []byte) ([]byte, bool)
+}
+
+// TransformerFunc adapts an ordinary function to the Transformer interface
+type TransformerFunc func(path string, content []byte) ([]byte, bool)
+
+// Transform calls f(path, content)
+func (f TransformerFunc) Transform(path string, content []byte) ([]byte, bool) {
+	return f(path, content)
+}
+
+// transformerNames lists the built-in transformers accepted by --transform
+var transformerNames = []string{"minify", "redact", "normalize-eol"}
+
+// newTransformer returns the built-in transformer with the given name
+func newTransformer(name string, config *Config) (Transformer, error) {
+	switch name {
+	case "minify":
+		return TransformerFunc(minify), nil
+	case "redact":
+		return redactTransformer{annotate: config.AnnotateTruncation}, nil
+	case "normalize-eol":
+		return TransformerFunc(normalizeLineEndings), nil
+	}
+	return nil, fmt.Errorf("unknown transformer %q (available: %s)", name, strings.Join(transformerNames, ", "))
+}
+
+// transformContent runs the content of path through the transformer chain: trailing
+// whitespace stripping and blank line collapsing, then config.Transformers in order,
+// then wrapping, which has to see the final lines
+func transformContent(path string, content []byte, config *Config) []byte {
+	var chain []Transformer
+	if config.StripTrailingSpace {
+		chain = append(chain, TransformerFunc(func(_ string, content []byte) ([]byte, bool) {
+			stripped := stripTrailingWhitespace(content)
+			return stripped, len(stripped) != len(content)
+		}))
+	}
+	if config.CollapseBlankLines {
+		chain = append(chain, TransformerFunc(func(_ string, content []byte) ([]byte, bool) {
+			collapsed := collapseBlankLines(content)
+			return collapsed, len(collapsed) != len(content)
+		}))
+	}
+	chain = append(chain, config.Transformers...)
+	if config.Wrap > 0 {
+		chain = append(chain, TransformerFunc(func(_ string, content []byte) ([]byte, bool) {
+			wrapped := wrapLines(content, config.Wrap)
+			return wrapped, len(wrapped) != len(content)
+		}))
+	}
+
+	for _, transformer := range chain {
+		transformed, changed := transformer.Transform(path, content)
+		if changed {
+			content = transformed
+		}
+	}
+	return content
+}
+
+// commentPrefixes maps extensions to the prefixes that start a line comment, for minify
+var commentPrefixes = map[string][]string{
+	".c":     {"//"},
+	".cc":    {"//"},
+	".cpp":   {"//"},
+	".cs":    {"//"},
+	".go":    {"//"},
+	".h":     {"//"},
+	".hpp":   {"//"},
+	".java":  {"//"},
+	".js":    {"//"},
+	".jsx":   {"//"},
+	".kt":    {"//"},
+	".lua":   {"--"},
+	".php":   {"//", "#"},
+	".pl":    {"#"},
+	".py":    {"#"},
+	".rb":    {"#"},
+	".rs":    {"//"},
+	".scala": {"//"},
+	".sh":    {"#"},
+	".sql":   {"--"},
+	".swift": {"//"},
+	".toml":  {"#"},
+	".ts":    {"//"},
+	".tsx":   {"//"},
+	".yaml":  {"#"},
+	".yml":   {"#"},
+}
+
+// directivePrefixes maps extensions to the prefixes of lines that look like
+// comments but change what the code means, so minify keeps them: Go build
+// constraints and compiler directives, and PHP 8 attributes
+var directivePrefixes = map[string][]string{
+	".go":  {"//go:", "// +build", "//export ", "//line "},
+	".php": {"#["},
+}
+
+// parseCommentStyles adds --comment-style overrides such as ".myext://,--" to
+// commentPrefixes. Since the flag splits values on commas, a value that doesn't
+// start a new ".ext:" adds another prefix to the extension before it.
+func parseCommentStyles(values []string) error {
+	ext := ""
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if name, prefix, ok := strings.Cut(value, ":"); ok && strings.HasPrefix(name, ".") {
+			ext = strings.ToLower(name)
+			commentPrefixes[ext] = nil
+			value = prefix
+		} else if ext == "" {
+			return fmt.Errorf("invalid comment style %q, expected .ext:prefix[,prefix...]", value)
+		}
+		if value == "" {
+			return fmt.Errorf("empty comment prefix for %s", ext)
+		}
+		commentPrefixes[ext] = append(commentPrefixes[ext], value)
+	}
+	return nil
+}
+
+// commentPrefixesByLanguage holds the line comment prefixes of languages that are
+// often written in files without an extension, found by detectLanguage
+var commentPrefixesByLanguage = map[string][]string{
+	"bash":     {"#"},
+	"cmake":    {"#"},
+	"makefile": {"#"},
+	"perl":     {"#"},
+	"python":   {"#"},
+	"ruby":     {"#"},
+}
+
+// minify drops blank lines, whole-line comments and trailing whitespace from files
+// whose extension, or else detected language, has known comment prefixes; other
+// files are left untouched. Indentation is kept, since it is significant in some
+// languages, as are a leading #! line and lines in directivePrefixes.
+func minify(path string, content []byte) ([]byte, bool) {
+	ext := strings.ToLower(filepath.Ext(path))
+	prefixes, ok := commentPrefixes[ext]
+	if !ok {
+		prefixes, ok = commentPrefixesByLanguage[detectLanguage(path, content)]
+	}
+	if !ok {
+		return content, false
+	}
+
+	lines := strings.Split(string(stripTrailingWhitespace(content)), "\n")
+	kept := lines[:0]
+	for i, line := range lines {
+		code := strings.TrimSpace(line)
+		directive := i == 0 && strings.HasPrefix(code, "#!") || hasAnyPrefix(code, directivePrefixes[ext])
+		if code == "" || !directive && hasAnyPrefix(code, prefixes) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	minified := strings.Join(kept, "\n")
+	if len(kept) > 0 && bytes.HasSuffix(content, []byte("\n")) {
+		minified += "\n"
+	}
+	return []byte(minified), len(minified) != len(content)
+}
+
+// hasAnyPrefix reports whether s starts with one of the prefixes
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeLineEndings converts CRLF and lone CR line endings to LF
+func normalizeLineEndings(_ string, content []byte) ([]byte, bool) {
+	if !bytes.Contains(content, []byte("\r")) {
+		return content, false
+	}
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(content, []byte("\r"), []byte("\n")), true
+}
+
+// secretPatterns match likely secrets. A pattern with capture groups only redacts
+// the group that matched, so the key name stays readable. Values after a key name
+// are only taken when they are literals, a quoted string or a bare word running
+// to the end of the line, so code such as password = os.Getenv("PASSWORD") is left
+// alone.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?im)(?:api[_-]?key|secret|token|passw(?:or)?d|access[_-]?key)[a-z0-9_-]*["']?[ \t]*(?::=|[:=])[ \t]*(?:"([^"\s]{8,})"|'([^'\s]{8,})'|([^\s"'(){}\[\],;]{8,})[ \t]*\r?$)`),
+	regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`),
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+}
+
+// redactTransformer replaces likely secrets with a placeholder, written as an
+// annotation with --annotate-truncation
+type redactTransformer struct {
+	annotate bool
+}
+
+// Transform redacts every match of secretPatterns in content
+func (r redactTransformer) Transform(_ string, content []byte) ([]byte, bool) {
+	placeholder := []byte("REDACTED")
+	if r.annotate {
+		placeholder = []byte(annotation("redacted secret"))
+	}
+
+	changed := false
+	for _, pattern := range secretPatterns {
+		content = pattern.ReplaceAllFunc(content, func(match []byte) []byte {
+			changed = true
+			groups := pattern.FindSubmatchIndex(match)
+			for i := 2; i+1 < len(groups); i += 2 {
+				if groups[i] < 0 {
+					continue
+				}
+				redacted := append([]byte{}, match[:groups[i]]...)
+				redacted = append(redacted, placeholder...)
+				return append(redacted, match[groups[i+1]:]...)
+			}
+			return placeholder
+		})
+	}
+	return content, changed
+}
+
+// wrapLines breaks lines longer than width runes into segments, ending every
+// segment but the last with WrapMarker
+func wrapLines(content []byte, width int) []byte {
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		body := strings.TrimSuffix(line, "\r")
+		runes := []rune(body)
+		if len(runes) <= width {
+			continue
+		}
+
+		var wrapped strings.Builder
+		for len(runes) > width {
+			wrapped.WriteString(string(runes[:width]))
+			wrapped.WriteString(WrapMarker + "\n")
+			runes = runes[width:]
+		}
+		wrapped.WriteString(string(runes))
+		wrapped.WriteString(line[len(body):])
+		lines[i] = wrapped.String()
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// stripTrailingWhitespace removes spaces and tabs at the end of each line,
+// keeping line endings (including CRLF) and the presence of a final newline intact
+func stripTrailingWhitespace(content []byte) []byte {
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		if strings.HasSuffix(line, "\r") {
+			lines[i] = strings.TrimRight(strings.TrimSuffix(line, "\r"), " \t") + "\r"
+		} else {
+			lines[i] = strings.TrimRight(line, " \t")
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// collapseBlankLines replaces every run of three or more whitespace-only lines with
+// the first line of the run. Shorter runs are kept, as they often separate sections.
+func collapseBlankLines(content []byte) []byte {
+	lines := strings.Split(string(content), "\n")
+	last := len(lines) - 1 // What follows the final newline, not a line of its own
+	kept := lines[:0]
+	for i := 0; i < len(lines); {
+		j := i
+		for j < last && strings.TrimSpace(lines[j]) == "" {
+			j++
+		}
+		switch {
+		case j-i >= 3:
+			kept = append(kept, lines[i])
+		case j == i:
+			j++
+			fallthrough
+		default:
+			kept = append(kept, lines[i:j]...)
+		}
+		i = j
+	}
+	return []byte(strings.Join(kept, "\n"))
+}
+
+// writeEnd writes the end marker and flushes the output so the marker can't be lost
+func writeEnd(output *outputWriter, formatter Formatter) error {
+	if err := formatter.WriteEnd(output); err != nil {
+		return err
+	}
+	return output.Flush()
+}
+
+// readBundleFile parses a text output file written by unfolder with the given --section-spacing
+func readBundleFile(path string, spacing int) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseBundle(file, spacing)
+}
+
+// isSymlinkNote reports whether the content of a text section is a --note-symlinks notice
+func isSymlinkNote(content string) bool {
+	return strings.HasPrefix(content, SymlinkNotice) && strings.HasSuffix(content, ")\n") && strings.Count(content, "\n") == 1
+}
+
+// parseBundle parses the text output format into file contents keyed by path.
+// Everything before the first divider (header, manifest) is skipped, parsing stops
+// at the end marker, sections referring to an identical file are resolved, and
+// --group-by-dir banners directly before a divider are dropped, and so are the
+// spacing blank lines written with --section-spacing before dividers and banners.
+func parseBundle(r io.Reader, spacing int) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	duplicates := make(map[string]string)
+	var order []string
+
+	reader := bufio.NewReader(r)
+	// An output written with --output-encoding=utf8-bom starts with a byte order mark
+	if bom, _ := reader.Peek(len(UTF8BOM)); string(bom) == UTF8BOM {
+		reader.Discard(len(UTF8BOM))
+	}
+	var current *strings.Builder
+	var currentPath string
+	var banner string // Possible group banner, held back until the next line shows what it is
+	expectPath := false
+
+	// spaced is set when a divider ends the section: the spacing before the divider, or
+	// before the banner dropped ahead of it, is then not part of the content
+	finish := func(spaced bool) {
+		if current == nil {
+			return
+		}
+		content := current.String()
+		if spaced {
+			if original, ok := strings.CutSuffix(content, strings.Repeat("\n", spacing)); ok && (original == "" || strings.HasSuffix(original, "\n")) {
+				content = original
+			}
+		}
+		if original, ok := strings.CutPrefix(content, "(identical to "); ok && strings.HasSuffix(original, ")\n") && strings.Count(content, "\n") == 1 {
+			duplicates[currentPath] = strings.TrimSuffix(original, ")\n")
+		} else if encoded, ok := strings.CutPrefix(content, Base64Notice+"\n"); ok {
+			if decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(encoded, "\n", "")); err == nil {
+				files[currentPath] = decoded
+			}
+		} else if content != RemovedNotice+"\n" && !(content == EmptyDirNotice+"\n" && strings.HasSuffix(currentPath, "/")) && !isSymlinkNote(content) {
+			// With --trailing-newline=false, the notice and the newline before it weren't in the file
+			if original, ok := strings.CutSuffix(content, "\n"+NoNewlineNotice+"\n"); ok {
+				content = original
+			}
+			files[currentPath] = []byte(content)
+		}
+		order = append(order, currentPath)
+		current = nil
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if line == "" && err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		trimmed := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		// Spacing blank lines between a banner and its divider are held back with the banner
+		bannerSpacing := banner != "" && trimmed == "" && strings.Count(banner, "\n") <= spacing
+		if banner != "" && !bannerSpacing {
+			if trimmed != SectionDivider && current != nil {
+				current.WriteString(banner)
+			}
+			banner = ""
+		}
+		switch {
+		case bannerSpacing:
+			banner += line
+		case expectPath:
+			currentPath = trimmed
+			current = &strings.Builder{}
+			expectPath = false
+		case trimmed == SectionDivider:
+			finish(true)
+			expectPath = true
+		case trimmed == EndMarker:
+			finish(false)
+			err = io.EOF
+		case isGroupBanner(trimmed):
+			banner = line
+		case current != nil:
+			current.WriteString(line)
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	finish(false)
+
+	for _, path := range order {
+		if original, ok := duplicates[path]; ok {
+			if content, ok := files[original]; ok {
+				files[path] = content
+			}
+		}
+	}
+	return files, nil
+}
+
+// isGroupBanner reports whether line looks like a --group-by-dir banner
+func isGroupBanner(line string) bool {
+	return len(line) > 2*len(GroupBanner)+2 && strings.HasPrefix(line, GroupBanner+" ") && strings.HasSuffix(line, " "+GroupBanner)
+}
+
+// Formatter renders the header, file sections and end marker of an output format
+type Formatter interface {
+	Extension() string
+	Description() string
+	WriteHeader(w io.Writer, description string) error
+	WriteManifest(w io.Writer, files []FileEntry) error
+	WriteFile(w io.Writer, relPath string, content []byte) error
+	WriteDuplicate(w io.Writer, relPath, originalPath string) error
+	WriteBinary(w io.Writer, relPath string, content []byte) error
+	WriteRemoved(w io.Writer, relPath string) error
+	WriteEmptyDir(w io.Writer, relPath string) error
+	WriteSymlink(w io.Writer, relPath, target string) error
+	WriteGroup(w io.Writer, dir string) error
+	WriteEnd(w io.Writer) error
+}
+
+// scratchFormatter is implemented by formatters that keep state between sections.
+// Scratch returns a copy writing to w, which renders what comes next as the
+// formatter would, without changing the formatter itself.
+type scratchFormatter interface {
+	Scratch(w io.Writer) Formatter
+}
+
+// renderedSize returns how many bytes write produces with a scratch copy of the
+// formatter, so limits can be checked before anything is written
+func renderedSize(formatter Formatter, write func(Formatter, io.Writer) error) int64 {
+	var counter countingWriter
+	if scratch, ok := formatter.(scratchFormatter); ok {
+		formatter = scratch.Scratch(&counter)
+	}
+	// A write that fails here fails again when it is done for real
+	write(formatter, &counter)
+	return counter.n
+}
+
+// writesReferences reports whether the formatter writes --dedup copies as references
+// to the first file, rather than repeating the content as the JSON tree does
+func writesReferences(formatter Formatter) bool {
+	if tee, ok := formatter.(*teeFormatter); ok {
+		formatter = tee.Formatter
+	}
+	json, ok := formatter.(*jsonFormatter)
+	return !ok || !json.tree
+}
+
+// ExtraOutput is an additional format written by the same run, to its own file
+type ExtraOutput struct {
+	Formatter Formatter
+	Path      string
+	absPath   string
+}
+
+// teeFormatter writes everything the primary formatter writes to the additional
+// outputs too, each in its own format. Only the primary writes to the writer it is given.
+type teeFormatter struct {
+	Formatter
+	targets []teeTarget
+}
+
+type teeTarget struct {
+	formatter   Formatter
+	output      *outputWriter
+	path        string
+	description string
+}
+
+// newTeeFormatter opens the additional outputs of config
+func newTeeFormatter(config *Config) (*teeFormatter, error) {
+	tee := &teeFormatter{Formatter: config.Formatter}
+	for _, extra := range config.ExtraOutputs {
+		output, err := openOutputFile(extra.Path, config)
+		if err != nil {
+			tee.Close()
+			return nil, fmt.Errorf("cannot create %s: %w", extra.Path, err)
+		}
+		tee.targets = append(tee.targets, teeTarget{
+			formatter:   extra.Formatter,
+			output:      output,
+			path:        extra.Path,
+			description: headerDescription(extra.Formatter, config),
+		})
+	}
+	return tee, nil
+}
+
+// Scratch measures the primary output only, which the limits apply to
+func (t *teeFormatter) Scratch(w io.Writer) Formatter {
+	if scratch, ok := t.Formatter.(scratchFormatter); ok {
+		return scratch.Scratch(w)
+	}
+	return t.Formatter
+}
+
+// each writes with the primary formatter, then with every target formatter
+func (t *teeFormatter) each(w io.Writer, write func(Formatter, io.Writer) error) error {
+	if err := write(t.Formatter, w); err != nil {
+		return err
+	}
+	for _, target := range t.targets {
+		if err := write(target.formatter, target.output); err != nil {
+			return fmt.Errorf("%s: %w", target.path, err)
+		}
+	}
+	return nil
+}
+
+// WriteHeader gives each target its own description, as if it were written alone
+func (t *teeFormatter) WriteHeader(w io.Writer, description string) error {
+	if err := t.Formatter.WriteHeader(w, description); err != nil {
+		return err
+	}
+	for _, target := range t.targets {
+		if err := target.formatter.WriteHeader(target.output, target.description); err != nil {
+			return fmt.Errorf("%s: %w", target.path, err)
+		}
+	}
+	return nil
+}
+
+func (t *teeFormatter) WriteManifest(w io.Writer, files []FileEntry) error {
+	return t.each(w, func(f Formatter, w io.Writer) error { return f.WriteManifest(w, files) })
+}
+
+func (t *teeFormatter) WriteFile(w io.Writer, relPath string, content []byte) error {
+	return t.each(w, func(f Formatter, w io.Writer) error { return f.WriteFile(w, relPath, content) })
+}
+
+func (t *teeFormatter) WriteDuplicate(w io.Writer, relPath, originalPath string) error {
+	return t.each(w, func(f Formatter, w io.Writer) error { return f.WriteDuplicate(w, relPath, originalPath) })
+}
+
+func (t *teeFormatter) WriteBinary(w io.Writer, relPath string, content []byte) error {
+	return t.each(w, func(f Formatter, w io.Writer) error { return f.WriteBinary(w, relPath, content) })
+}
+
+func (t *teeFormatter) WriteRemoved(w io.Writer, relPath string) error {
+	return t.each(w, func(f Formatter, w io.Writer) error { return f.WriteRemoved(w, relPath) })
+}
+
+func (t *teeFormatter) WriteEmptyDir(w io.Writer, relPath string) error {
+	return t.each(w, func(f Formatter, w io.Writer) error { return f.WriteEmptyDir(w, relPath) })
+}
+
+func (t *teeFormatter) WriteSymlink(w io.Writer, relPath, target string) error {
+	return t.each(w, func(f Formatter, w io.Writer) error { return f.WriteSymlink(w, relPath, target) })
+}
+
+func (t *teeFormatter) WriteGroup(w io.Writer, dir string) error {
+	return t.each(w, func(f Formatter, w io.Writer) error { return f.WriteGroup(w, dir) })
+}
+
+// WriteEnd ends every output and flushes the targets, which the caller does not know about
+func (t *teeFormatter) WriteEnd(w io.Writer) error {
+	return t.each(w, func(f Formatter, w io.Writer) error {
+		if err := f.WriteEnd(w); err != nil {
+			return err
+		}
+		if output, ok := w.(*outputWriter); ok {
+			return output.Flush()
+		}
+		return nil
+	})
+}
+
+// WriteStats writes the stats to every output whose format supports them
+func (t *teeFormatter) WriteStats(w io.Writer, stats *Stats, runErr error) error {
+	return t.each(w, func(f Formatter, w io.Writer) error {
+		if sw, ok := f.(statsWriter); ok {
+			return sw.WriteStats(w, stats, runErr)
+		}
+		return nil
+	})
+}
+
+// Close closes the additional outputs
+func (t *teeFormatter) Close() {
+	for _, target := range t.targets {
+		if err := target.output.Close(); err != nil {
+			printWarning("Could not close %s: %v", target.path, err)
+		}
+	}
+}
+
+// findTextFormatter returns the text formatter among the formats being written, if any
+func findTextFormatter(formatter Formatter) (textFormatter, bool) {
+	tee, ok := formatter.(*teeFormatter)
+	if !ok {
+		text, ok := formatter.(textFormatter)
+		return text, ok
+	}
+	if text, ok := tee.Formatter.(textFormatter); ok {
+		return text, true
+	}
+	for _, target := range tee.targets {
+		if text, ok := target.formatter.(textFormatter); ok {
+			return text, true
+		}
+	}
+	return textFormatter{}, false
+}
+
+// formatByExtension maps output file extensions to the format they imply
+var formatByExtension = map[string]string{
+	".xml":    "xml",
+	".html":   "html",
+	".htm":    "html",
+	".json":   "json",
+	".ndjson": "ndjson",
+	".jsonl":  "ndjson",
+	".yaml":   "yaml",
+	".yml":    "yaml",
+	".tar":    "tar",
+	".tgz":    "tar.gz",
+}
+
+// formatForOutput returns the format implied by the output file's extension,
+// text for any other extension
+func formatForOutput(output string) string {
+	if strings.HasSuffix(strings.ToLower(output), ".tar.gz") {
+		return "tar.gz"
+	}
+	if format, ok := formatByExtension[strings.ToLower(filepath.Ext(output))]; ok {
+		return format
+	}
+	return "text"
+}
+
+// newFormatter returns the formatter for the configured --format value
+func newFormatter(config *Config) (Formatter, error) {
+	format := config.Format
+	switch strings.ToLower(format) {
+	case "", "text", "txt":
+		fileTemplate, err := parseFileTemplate(config.FileTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file template: %v", err)
+		}
+		return textFormatter{nullSeparated: config.NullSeparated, fileTemplate: fileTemplate, noEndMarker: config.NoEndMarker, noTrailingNewline: config.NoTrailingNewline, sectionSpacing: config.SectionSpacing}, nil
+	case "xml", "html", "htm", "ndjson", "jsonl", "json", "yaml", "yml", "tar", "tar.gz", "tgz":
+		if config.FileTemplate != "" {
+			return nil, fmt.Errorf("--file-template only applies to the text format")
+		}
+		switch strings.ToLower(format) {
+		case "xml":
+			return xmlFormatter{}, nil
+		case "ndjson", "jsonl":
+			return ndjsonFormatter{}, nil
+		case "json":
+			return &jsonFormatter{tree: config.PreserveStructure, compact: config.JSONCompact}, nil
+		case "yaml", "yml":
+			return &yamlFormatter{}, nil
+		case "tar":
+			return &tarFormatter{}, nil
+		case "tar.gz", "tgz":
+			return &tarFormatter{compress: true}, nil
+		}
+		return htmlFormatter{highlight: config.Highlight}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q (expected text, xml, html, json, ndjson, yaml, tar or tar.gz)", format)
+	}
+}
+
+// textFormatter writes the plain divider-based format
+type textFormatter struct {
+	nullSeparated     bool               // Terminate manifest entries with NUL instead of newline (--null)
+	fileTemplate      *template.Template // Layout of each file section (--file-template)
+	noEndMarker       bool               // Leave out the end marker (--no-end-marker)
+	noTrailingNewline bool               // Mark a missing final newline instead of adding one (--trailing-newline=false)
+	sectionSpacing    int                // Blank lines before each section (--section-spacing)
+}
+
+// writeSpacing writes the blank lines that precede a section or group banner
+func (f textFormatter) writeSpacing(w io.Writer) error {
+	if f.sectionSpacing == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w, strings.Repeat("\n", f.sectionSpacing))
+	return err
+}
+
+func (textFormatter) Extension() string { return "txt" }
+
+func (f textFormatter) Description() string {
+	if f.noEndMarker {
+		return headerWithoutEndMarker
+	}
+	return header
+}
+
+func (textFormatter) WriteHeader(w io.Writer, description string) error {
+	if description == "" {
+		return nil
+	}
+	_, err := fmt.Fprintln(w, description)
+	return err
+}
+
+func (f textFormatter) WriteManifest(w io.Writer, files []FileEntry) error {
+	fmt.Fprintln(w, "Manifest:")
+	if f.nullSeparated {
+		// Paths may contain newlines, so entries can't be aligned as a table
+		for _, file := range files {
+			fmt.Fprintf(w, "%d\t%d\t%s\x00", file.Lines, file.Size, file.RelPath)
+		}
+		_, err := fmt.Fprintln(w)
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "LINES\tBYTES\t  PATH")
+	for _, file := range files {
+		fmt.Fprintf(tw, "%d\t%d\t  %s\n", file.Lines, file.Size, file.RelPath)
+	}
+	return tw.Flush()
+}
+
+func (f textFormatter) WriteFile(w io.Writer, relPath string, content []byte) error {
+	sum := sha256.Sum256(content)
+	data := FileData{
+		Divider:  SectionDivider,
+		Path:     relPath,
+		Content:  string(content),
+		Size:     int64(len(content)),
+		Hash:     hex.EncodeToString(sum[:]),
+		Language: detectLanguage(relPath, content),
+	}
+
+	// Ensure newline after content, so the next divider starts a line
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		data.Content += "\n"
+		if f.noTrailingNewline {
+			data.Content += NoNewlineNotice + "\n"
+		}
+	}
+
+	if err := f.writeSpacing(w); err != nil {
+		return err
+	}
+	return f.fileTemplate.Execute(w, data)
+}
+
+func (f textFormatter) WriteBinary(w io.Writer, relPath string, content []byte) error {
+	if err := f.writeSpacing(w); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n%s\n%s\n", SectionDivider, relPath, Base64Notice)
+	return writeBase64Lines(w, content)
+}
+
+// writeBase64Lines writes content base64-encoded in lines of Base64LineLength characters
+func writeBase64Lines(w io.Writer, content []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > Base64LineLength {
+		if _, err := fmt.Fprintln(w, encoded[:Base64LineLength]); err != nil {
+			return err
+		}
+		encoded = encoded[Base64LineLength:]
+	}
+	if encoded == "" {
+		return nil
+	}
+	_, err := fmt.Fprintln(w, encoded)
+	return err
+}
+
+func (f textFormatter) WriteDuplicate(w io.Writer, relPath, originalPath string) error {
+	if err := f.writeSpacing(w); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s\n%s\n(identical to %s)\n", SectionDivider, relPath, originalPath)
+	return err
+}
+
+func (f textFormatter) WriteRemoved(w io.Writer, relPath string) error {
+	if err := f.writeSpacing(w); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s\n%s\n%s\n", SectionDivider, relPath, RemovedNotice)
+	return err
+}
+
+func (f textFormatter) WriteEmptyDir(w io.Writer, relPath string) error {
+	if err := f.writeSpacing(w); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s\n%s\n%s\n", SectionDivider, relPath, EmptyDirNotice)
+	return err
+}
+
+func (f textFormatter) WriteSymlink(w io.Writer, relPath, target string) error {
+	if err := f.writeSpacing(w); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s\n%s\n%s%s)\n", SectionDivider, relPath, SymlinkNotice, target)
+	return err
+}
+
+func (f textFormatter) WriteGroup(w io.Writer, dir string) error {
+	if err := f.writeSpacing(w); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s %s %s\n", GroupBanner, dir, GroupBanner)
+	return err
+}
+
+func (f textFormatter) WriteEnd(w io.Writer) error {
+	if f.noEndMarker {
+		return nil
+	}
+	_, err := fmt.Fprintln(w, EndMarker)
+	return err
+}
+
+// ndjsonFormatter writes one JSON object per line and ends with a stats object
+type ndjsonFormatter struct{}
+
+// ndjsonRecord is one line of ndjson output; only the fields of its kind are set
+type ndjsonRecord struct {
+	Header      string               `json:"header,omitempty" yaml:"header,omitempty"`
+	Manifest    []ndjsonManifestItem `json:"manifest,omitempty" yaml:"manifest,omitempty"`
+	Group       string               `json:"group,omitempty" yaml:"group,omitempty"`
+	Path        string               `json:"path,omitempty" yaml:"path,omitempty"`
+	Content     *string              `json:"content,omitempty" yaml:"content,omitempty"`
+	Encoding    string               `json:"encoding,omitempty" yaml:"encoding,omitempty"`
+	DuplicateOf string               `json:"duplicate_of,omitempty" yaml:"duplicate_of,omitempty"`
+	Removed     bool                 `json:"removed,omitempty" yaml:"removed,omitempty"`
+	EmptyDir    bool                 `json:"empty_dir,omitempty" yaml:"empty_dir,omitempty"`
+	Symlink     string               `json:"symlink,omitempty" yaml:"symlink,omitempty"`
+	Stats       *Stats               `json:"stats,omitempty" yaml:"stats,omitempty"`
+	Error       string               `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// ndjsonManifestItem describes one file in the ndjson manifest object
+type ndjsonManifestItem struct {
+	Path  string `json:"path" yaml:"path"`
+	Lines int    `json:"lines" yaml:"lines"`
+	Size  int64  `json:"size" yaml:"size"`
+}
+
+func (ndjsonFormatter) Extension() string { return "ndjson" }
+
+func (ndjsonFormatter) Description() string { return ndjsonHeader }
+
+func (f ndjsonFormatter) WriteHeader(w io.Writer, description string) error {
+	if description == "" {
+		return nil
 	}
+	return f.write(w, ndjsonRecord{Header: description})
+}
 
-	// Determine output file path
-	outputPath, err := determineOutputPath(config.Directory, config.Output)
-	if err != nil {
-		return cli.Exit(fmt.Sprintf("Error determining output path: %v", err), 1)
+func (f ndjsonFormatter) WriteManifest(w io.Writer, files []FileEntry) error {
+	items := make([]ndjsonManifestItem, 0, len(files))
+	for _, file := range files {
+		items = append(items, ndjsonManifestItem{Path: file.RelPath, Lines: file.Lines, Size: file.Size})
 	}
-	config.OutputPath = outputPath
+	return f.write(w, ndjsonRecord{Manifest: items})
+}
 
-	// Process the repository
-	if err := processRepository(config.Directory, config.OutputPath, config); err != nil {
-		return cli.Exit(fmt.Sprintf("%v", err), 1)
-	}
+func (f ndjsonFormatter) WriteFile(w io.Writer, relPath string, content []byte) error {
+	text := string(content)
+	return f.write(w, ndjsonRecord{Path: relPath, Content: &text})
+}
 
-	// Write --END-- marker
-	if err := writeEnd(config.OutputPath); err != nil {
-		printWarning("Could not write end marker: %v", err)
-	}
+func (f ndjsonFormatter) WriteBinary(w io.Writer, relPath string, content []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	return f.write(w, ndjsonRecord{Path: relPath, Content: &encoded, Encoding: "base64"})
+}
 
-	fmt.Printf("Repository contents written to %s\n", config.OutputPath)
+func (f ndjsonFormatter) WriteDuplicate(w io.Writer, relPath, originalPath string) error {
+	return f.write(w, ndjsonRecord{Path: relPath, DuplicateOf: originalPath})
+}
 
-	// Show warning summary if any warnings occurred
-	if warningCount > 0 {
-		fmt.Fprintf(os.Stderr, "\nNote: %d warning(s) occurred during processing. Some files may have been skipped due to permission issues.\n", warningCount)
-	}
+func (f ndjsonFormatter) WriteRemoved(w io.Writer, relPath string) error {
+	return f.write(w, ndjsonRecord{Path: relPath, Removed: true})
+}
 
-	return nil
+func (f ndjsonFormatter) WriteEmptyDir(w io.Writer, relPath string) error {
+	return f.write(w, ndjsonRecord{Path: relPath, EmptyDir: true})
 }
 
-func determineOutputPath(directory, output string) (string, error) {
-	// Get the base directory name
-	absDir, err := filepath.Abs(directory)
-	if err != nil {
-		return "", err
-	}
-	baseName := filepath.Base(absDir)
-	defaultFilename := baseName + ".txt"
+func (f ndjsonFormatter) WriteSymlink(w io.Writer, relPath, target string) error {
+	return f.write(w, ndjsonRecord{Path: relPath, Symlink: target})
+}
 
-	// No output specified, use current directory
-	if output == "" {
-		return defaultFilename, nil
-	}
+func (f ndjsonFormatter) WriteGroup(w io.Writer, dir string) error {
+	return f.write(w, ndjsonRecord{Group: dir})
+}
 
-	// Output is a directory
-	if strings.HasSuffix(output, "/") || strings.HasSuffix(output, "\\") {
-		return filepath.Join(output, defaultFilename), nil
-	}
+// WriteEnd writes nothing; the stream ends with the stats object instead
+func (ndjsonFormatter) WriteEnd(w io.Writer) error { return nil }
 
-	// Output is a file path
-	return output, nil
+func (f ndjsonFormatter) WriteStats(w io.Writer, stats *Stats, runErr error) error {
+	record := ndjsonRecord{Stats: stats}
+	if runErr != nil {
+		record.Error = runErr.Error()
+	}
+	return f.write(w, record)
 }
 
-func processRepository(directory, outputPath string, config *Config) error {
-	// Get absolute path and resolve symlinks for the root directory FIRST
-	absDir, err := filepath.Abs(directory)
+// write encodes one record as a single line
+func (ndjsonFormatter) write(w io.Writer, record ndjsonRecord) error {
+	line, err := json.Marshal(record)
 	if err != nil {
 		return err
 	}
+	_, err = fmt.Fprintf(w, "%s\n", line)
+	return err
+}
 
-	// FIXED: Resolve symlinks for the root directory
-	// This ensures that if the root directory is a symlink, we work with the actual directory
-	resolvedDir, err := filepath.EvalSymlinks(absDir)
-	if err != nil {
-		return fmt.Errorf("could not resolve directory path %s: %v", absDir, err)
-	}
+// jsonFormatter writes a single JSON document: a flat files array, or with
+// --preserve-structure a tree of nested directory objects written at the end.
+// The document is indented unless compact is set.
+type jsonFormatter struct {
+	tree     bool           // Write a nested tree instead of the files array
+	compact  bool           // Write the document on one line, without indentation
+	members  int            // Members written to the document object so far
+	entries  int            // Entries written to the files array so far
+	root     map[string]any // The tree built so far
+	contents map[string]any // Leaf values by path, to resolve duplicates
+}
 
-	// Load ignore patterns using the resolved directory
-	ignorePatterns, err := loadIgnorePatterns(resolvedDir)
-	if err != nil {
-		return err
+func (*jsonFormatter) Extension() string { return "json" }
+
+func (f *jsonFormatter) Description() string {
+	if f.tree {
+		return jsonTreeHeader
 	}
+	return jsonHeader
+}
 
-	absOutput, err := filepath.Abs(outputPath)
-	if err != nil {
+func (f *jsonFormatter) WriteHeader(w io.Writer, description string) error {
+	// The formatter is reused by --watch, so every document starts afresh
+	f.members = 0
+	f.entries = 0
+	f.root = make(map[string]any)
+	f.contents = make(map[string]any)
+
+	// --no-header leaves the description out, as the other formats do
+	if description == "" {
+		_, err := io.WriteString(w, "{")
 		return err
 	}
-
-	// Create output file and write header
-	output, err := createOutputFile(outputPath)
+	encoded, err := f.encode(description, 1)
 	if err != nil {
 		return err
 	}
-	defer output.Close()
-
-	// Walk through files using the resolved directory
-	return walkAndProcessFiles(resolvedDir, absOutput, ignorePatterns, output, config)
+	_, err = fmt.Fprintf(w, "{%s%s", f.member("description"), encoded)
+	return err
 }
 
-// createOutputFile creates the output file and writes the header
-func createOutputFile(outputPath string) (*os.File, error) {
-	output, err := os.Create(outputPath)
+func (f *jsonFormatter) WriteManifest(w io.Writer, files []FileEntry) error {
+	items := make([]ndjsonManifestItem, 0, len(files))
+	for _, file := range files {
+		items = append(items, ndjsonManifestItem{Path: file.RelPath, Lines: file.Lines, Size: file.Size})
+	}
+	encoded, err := f.encode(items, 1)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	// Write header
-	fmt.Fprintln(output, header)
-	return output, nil
+	_, err = fmt.Fprintf(w, "%s%s", f.member("manifest"), encoded)
+	return err
 }
 
-// walkAndProcessFiles walks through the directory and processes each file
-func walkAndProcessFiles(absDir, absOutput string, ignorePatterns []IgnorePattern, output *os.File, config *Config) error {
-	return filepath.WalkDir(absDir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			// Handle permission errors for directories
-			if os.IsPermission(err) {
-				printWarning("Permission denied accessing %s: %v", path, err)
-				return filepath.SkipDir // Skip this directory and its contents
-			}
-			return err
-		}
-
-		// Get relative path for ignore checking
-		relPath, err := filepath.Rel(absDir, path)
-		if err != nil {
-			printWarning("Could not get relative path for %s: %v", path, err)
-			return nil
-		}
-
-		// Check if directory should be ignored (before entering it)
-		if d.IsDir() {
-			// Don't ignore the root directory itself, only subdirectories
-			if relPath != "." && shouldIgnore(relPath, ignorePatterns, config) {
-				return filepath.SkipDir // Skip this directory and its contents
-			}
-			return nil // Continue into this directory
-		}
-
-		// For files, process normally
-		return processDirectoryEntry(path, d, absDir, absOutput, ignorePatterns, output, config)
-	})
+func (f *jsonFormatter) WriteFile(w io.Writer, relPath string, content []byte) error {
+	text := string(content)
+	if f.tree {
+		return f.addLeaf(relPath, text)
+	}
+	return f.writeEntry(w, ndjsonRecord{Path: relPath, Content: &text})
 }
 
-// processDirectoryEntry processes a single directory entry (file or subdirectory)
-func processDirectoryEntry(path string, d fs.DirEntry, absDir, absOutput string, ignorePatterns []IgnorePattern, output *os.File, config *Config) error {
-	// Skip if it's the output file itself
-	if absPath, _ := filepath.Abs(path); absPath == absOutput {
-		return nil
+func (f *jsonFormatter) WriteBinary(w io.Writer, relPath string, content []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	if f.tree {
+		return f.addLeaf(relPath, encoded)
 	}
+	return f.writeEntry(w, ndjsonRecord{Path: relPath, Content: &encoded, Encoding: "base64"})
+}
 
-	// Skip symlinks (but only if they're directories to avoid infinite loops)
-	if d.Type()&fs.ModeSymlink != 0 {
-		// Check if the symlink points to a directory
-		info, err := os.Stat(path)
-		if err != nil {
-			// If we can't stat it, skip it
-			return nil
-		}
-		if info.IsDir() {
-			// Skip symlinked directories to avoid infinite loops
-			return nil
-		}
-		// Allow symlinked files (common in config management)
+func (f *jsonFormatter) WriteDuplicate(w io.Writer, relPath, originalPath string) error {
+	if f.tree {
+		// A tree has no place for references, so the content is repeated
+		return f.addLeaf(relPath, f.contents[originalPath])
 	}
+	return f.writeEntry(w, ndjsonRecord{Path: relPath, DuplicateOf: originalPath})
+}
 
-	// Get relative path
-	relPath, err := filepath.Rel(absDir, path)
-	if err != nil {
-		// This is unusual, but continue processing
-		printWarning("Could not get relative path for %s: %v", path, err)
-		return nil
+func (f *jsonFormatter) WriteRemoved(w io.Writer, relPath string) error {
+	if f.tree {
+		return f.addLeaf(relPath, nil)
 	}
+	return f.writeEntry(w, ndjsonRecord{Path: relPath, Removed: true})
+}
 
-	// Check if file should be ignored
-	if shouldIgnore(relPath, ignorePatterns, config) {
+func (f *jsonFormatter) WriteEmptyDir(w io.Writer, relPath string) error {
+	if f.tree {
+		f.directory(strings.Split(strings.TrimSuffix(filepath.ToSlash(relPath), "/"), "/"))
 		return nil
 	}
+	return f.writeEntry(w, ndjsonRecord{Path: relPath, EmptyDir: true})
+}
 
-	// Check if file is binary
-	if isBinary(path) {
-		return nil
+func (f *jsonFormatter) WriteSymlink(w io.Writer, relPath, target string) error {
+	if f.tree {
+		return f.addLeaf(relPath, map[string]any{JSONSymlinkKey: target})
 	}
-
-	// Process file
-	return processFile(path, relPath, output)
+	return f.writeEntry(w, ndjsonRecord{Path: relPath, Symlink: target})
 }
 
-func loadIgnorePatterns(directory string) ([]IgnorePattern, error) {
-	var patterns []IgnorePattern
+func (*jsonFormatter) WriteGroup(w io.Writer, dir string) error { return nil }
 
-	// The directory should already be resolved by the caller
-	// But just to be safe, make it absolute if it isn't already
-	absDir := directory
-	if !filepath.IsAbs(directory) {
-		var err error
-		absDir, err = filepath.Abs(directory)
+func (f *jsonFormatter) WriteEnd(w io.Writer) error {
+	if f.tree {
+		encoded, err := f.encode(f.root, 1)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		_, err = fmt.Fprintf(w, "%s%s%s}\n", f.member("tree"), encoded, f.newline(0))
+		return err
+	}
+	if f.entries == 0 {
+		_, err := fmt.Fprintf(w, "%s[]%s}\n", f.member("files"), f.newline(0))
+		return err
 	}
+	_, err := fmt.Fprintf(w, "%s]%s}\n", f.newline(1), f.newline(0))
+	return err
+}
 
-	// Load ignore patterns incrementally, respecting already-loaded patterns
-	err := loadIgnorePatternsRecursive(absDir, "", &patterns)
-	return patterns, err
+// Scratch copies the formatter's position in the document. A tree is only written
+// at the end, so its leaves are measured as entries of the files array, which take
+// a little more room than the same leaves in the tree.
+func (f *jsonFormatter) Scratch(io.Writer) Formatter {
+	if f.tree {
+		return &jsonFormatter{compact: f.compact, members: f.members, entries: 1}
+	}
+	scratch := *f
+	return &scratch
 }
 
-// loadIgnorePatternsRecursive loads ignore patterns recursively, respecting already-loaded patterns
-func loadIgnorePatternsRecursive(absDir, relDir string, patterns *[]IgnorePattern) error {
-	// Build current path
-	currentPath := absDir
-	if relDir != "" {
-		currentPath = filepath.Join(absDir, relDir)
+// writeEntry writes one object of the files array, which is opened by the first one
+func (f *jsonFormatter) writeEntry(w io.Writer, record ndjsonRecord) error {
+	encoded, err := f.encode(record, 2)
+	if err != nil {
+		return err
+	}
+	separator := ","
+	if f.entries == 0 {
+		separator = f.member("files") + "["
 	}
+	f.entries++
+	_, err = fmt.Fprintf(w, "%s%s%s", separator, f.newline(2), encoded)
+	return err
+}
 
-	// Check if current directory should be ignored based on already-loaded patterns
-	if relDir != "" && shouldIgnore(relDir, *patterns, &Config{IncludeVCSDirectories: false}) {
-		return nil // Skip this directory entirely
+// member starts a member of the document object, after a comma unless it is the first
+func (f *jsonFormatter) member(name string) string {
+	f.members++
+	if f.members == 1 {
+		return f.key(name, 1)
 	}
+	return "," + f.key(name, 1)
+}
 
-	// Read .gitignore and .unfolderignore files in current directory
-	ignoreFiles := []string{".gitignore", ".unfolderignore"}
-	for _, ignoreFile := range ignoreFiles {
-		ignorePath := filepath.Join(currentPath, ignoreFile)
-		if filePatterns, err := readIgnoreFileWithContext(ignorePath, relDir); err == nil {
-			*patterns = append(*patterns, filePatterns...)
-		}
+// encode marshals a value nested depth levels deep in the document
+func (f *jsonFormatter) encode(value any, depth int) ([]byte, error) {
+	if f.compact {
+		return json.Marshal(value)
 	}
+	return json.MarshalIndent(value, strings.Repeat("  ", depth), "  ")
+}
 
-	// List directory contents
-	entries, err := os.ReadDir(currentPath)
-	if err != nil {
-		if os.IsPermission(err) {
-			printWarning("Permission denied accessing %s: %v", currentPath, err)
-			return nil
-		}
-		return err
+// key starts a member of an object nested depth levels deep, on its own line
+func (f *jsonFormatter) key(name string, depth int) string {
+	if f.compact {
+		return fmt.Sprintf("%q:", name)
 	}
+	return fmt.Sprintf("%s%q: ", f.newline(depth), name)
+}
 
-	// Process subdirectories
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
+// newline starts a new line indented depth levels, or nothing when compact
+func (f *jsonFormatter) newline(depth int) string {
+	if f.compact {
+		return ""
+	}
+	return "\n" + strings.Repeat("  ", depth)
+}
 
-		// Skip VCS directories
-		if !shouldIgnore(entry.Name(), *patterns, &Config{IncludeVCSDirectories: false}) {
-			// Build relative path for subdirectory
-			subRelDir := entry.Name()
-			if relDir != "" {
-				subRelDir = filepath.Join(relDir, entry.Name())
-			}
+// addLeaf places a file's value in the tree. A file whose name is already taken
+// by a directory, or the other way round, gets JSONFileSuffix appended to its name.
+func (f *jsonFormatter) addLeaf(relPath string, value any) error {
+	segments := strings.Split(filepath.ToSlash(relPath), "/")
+	parent := f.directory(segments[:len(segments)-1])
+	name := segments[len(segments)-1]
+	if _, isDir := parent[name].(map[string]any); isDir {
+		printWarning("%s is also a directory; storing the file as %q in the tree", relPath, name+JSONFileSuffix)
+		name += JSONFileSuffix
+	}
+	parent[name] = value
+	f.contents[relPath] = value
+	return nil
+}
 
-			// Recursively load patterns from subdirectory
-			if err := loadIgnorePatternsRecursive(absDir, subRelDir, patterns); err != nil {
-				return err
+// directory returns the tree object for a directory, creating it and its parents.
+// A file already holding one of the names is moved aside to the name with JSONFileSuffix.
+func (f *jsonFormatter) directory(segments []string) map[string]any {
+	current := f.root
+	for i, segment := range segments {
+		next, ok := current[segment].(map[string]any)
+		if !ok {
+			if value, exists := current[segment]; exists {
+				filePath := strings.Join(segments[:i+1], "/")
+				printWarning("%s is also a directory; storing the file as %q in the tree", filePath, segment+JSONFileSuffix)
+				current[segment+JSONFileSuffix] = value
 			}
+			next = make(map[string]any)
+			current[segment] = next
 		}
+		current = next
 	}
+	return current
+}
 
-	return nil
+// yamlFormatter writes a single YAML document with the same fields as the JSON
+// format. File contents are literal block scalars wherever YAML allows them.
+type yamlFormatter struct {
+	entries int // Entries written to the files list so far
 }
 
-func readIgnoreFile(path string) ([]string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		// Check if it's a permission error
-		if os.IsPermission(err) {
-			printWarning("Permission denied reading %s: %v", path, err)
-			return nil, nil // Return empty patterns, continue processing
-		}
-		return nil, err
+func (*yamlFormatter) Extension() string { return "yaml" }
+
+func (*yamlFormatter) Description() string { return yamlHeader }
+
+func (f *yamlFormatter) WriteHeader(w io.Writer, description string) error {
+	// The formatter is reused by --watch, so every document starts afresh
+	f.entries = 0
+	// --no-header leaves the description out, as the other formats do
+	if description == "" {
+		return nil
 	}
-	defer file.Close()
+	return writeYAML(w, map[string]string{"description": description})
+}
 
-	var patterns []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		// Skip empty lines and comments
-		if line != "" && !strings.HasPrefix(line, "#") {
-			patterns = append(patterns, line)
-		}
+func (f *yamlFormatter) WriteManifest(w io.Writer, files []FileEntry) error {
+	items := make([]ndjsonManifestItem, 0, len(files))
+	for _, file := range files {
+		items = append(items, ndjsonManifestItem{Path: file.RelPath, Lines: file.Lines, Size: file.Size})
 	}
+	return writeYAML(w, map[string][]ndjsonManifestItem{"manifest": items})
+}
 
-	return patterns, scanner.Err()
+func (f *yamlFormatter) WriteFile(w io.Writer, relPath string, content []byte) error {
+	text := string(content)
+	return f.writeEntry(w, ndjsonRecord{Path: relPath, Content: &text})
 }
 
-func readIgnoreFileWithContext(path, ignoreDir string) ([]IgnorePattern, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		// Check if it's a permission error
-		if os.IsPermission(err) {
-			printWarning("Permission denied reading %s: %v", path, err)
-			return nil, nil // Return empty patterns, continue processing
-		}
-		return nil, err
-	}
-	defer file.Close()
+func (f *yamlFormatter) WriteBinary(w io.Writer, relPath string, content []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	return f.writeEntry(w, ndjsonRecord{Path: relPath, Content: &encoded, Encoding: "base64"})
+}
 
-	var patterns []IgnorePattern
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		// Skip empty lines and comments
-		if line != "" && !strings.HasPrefix(line, "#") {
-			isNegated := strings.HasPrefix(line, "!")
-			pattern := line
-			if isNegated {
-				pattern = strings.TrimPrefix(line, "!")
-			}
+func (f *yamlFormatter) WriteDuplicate(w io.Writer, relPath, originalPath string) error {
+	return f.writeEntry(w, ndjsonRecord{Path: relPath, DuplicateOf: originalPath})
+}
 
-			patterns = append(patterns, IgnorePattern{
-				Pattern:   pattern,
-				Dir:       ignoreDir,
-				IsNegated: isNegated,
-			})
-		}
+func (f *yamlFormatter) WriteRemoved(w io.Writer, relPath string) error {
+	return f.writeEntry(w, ndjsonRecord{Path: relPath, Removed: true})
+}
+
+func (f *yamlFormatter) WriteEmptyDir(w io.Writer, relPath string) error {
+	return f.writeEntry(w, ndjsonRecord{Path: relPath, EmptyDir: true})
+}
+
+func (f *yamlFormatter) WriteSymlink(w io.Writer, relPath, target string) error {
+	return f.writeEntry(w, ndjsonRecord{Path: relPath, Symlink: target})
+}
+
+func (*yamlFormatter) WriteGroup(w io.Writer, dir string) error { return nil }
+
+func (f *yamlFormatter) WriteEnd(w io.Writer) error {
+	if f.entries > 0 {
+		return nil
 	}
+	_, err := fmt.Fprintln(w, "files: []")
+	return err
+}
 
-	return patterns, scanner.Err()
+// Scratch copies the formatter's position in the files list
+func (f *yamlFormatter) Scratch(io.Writer) Formatter {
+	scratch := *f
+	return &scratch
 }
 
-func shouldIgnore(filePath string, patterns []IgnorePattern, config *Config) bool {
-	// Check VCS directories first (unless explicitly included)
-	if !config.IncludeVCSDirectories {
-		for _, vcsDir := range vcsDirectories {
-			// Check if the path contains a VCS directory anywhere in the path
-			// This handles cases like "baserow/.git/HEAD" or "project/.svn/entries"
-			pathParts := strings.Split(filepath.ToSlash(filePath), "/")
-			for _, part := range pathParts {
-				if part == strings.TrimSuffix(vcsDir, "/") {
-					return true
-				}
-			}
+// writeEntry writes one item of the files list, with the content as a literal
+// block scalar. The encoder falls back to a quoted scalar for content a block
+// scalar cannot hold, such as trailing spaces on the last line.
+func (f *yamlFormatter) writeEntry(w io.Writer, record ndjsonRecord) error {
+	var entry yaml.Node
+	if err := entry.Encode(record); err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(entry.Content); i += 2 {
+		if entry.Content[i].Value == "content" {
+			entry.Content[i+1].Style = yaml.LiteralStyle
 		}
 	}
-
-	// Check user-defined patterns with Git-like behavior
-	// Each .gitignore affects its own directory and sub-directories
-	for _, pattern := range patterns {
-		// Check if this pattern applies to the current file path
-		if isPatternApplicable(filePath, pattern) {
-			if pattern.IsNegated {
-				// Negated patterns override previous ignore decisions
-				return false
-			} else {
-				// Regular ignore pattern
-				return true
-			}
+	if f.entries == 0 {
+		if _, err := fmt.Fprintln(w, "files:"); err != nil {
+			return err
 		}
 	}
-	return false
+	f.entries++
+	return writeYAML(w, []*yaml.Node{&entry})
+}
+
+// writeYAML encodes one top-level value with two-space indentation
+func writeYAML(w io.Writer, value any) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+	return encoder.Close()
 }
 
-// isPatternApplicable checks if a pattern from a specific directory applies to the given file path
-func isPatternApplicable(filePath string, pattern IgnorePattern) bool {
-	// Convert paths to forward slashes for consistent matching
-	filePath = filepath.ToSlash(filePath)
-	patternDir := filepath.ToSlash(pattern.Dir)
-	patternText := filepath.ToSlash(pattern.Pattern)
+// tarFormatter writes the selected files into a tar archive, gzip-compressed with
+// compress. The archive has no room for a description, manifest or group banners.
+type tarFormatter struct {
+	compress bool
+	gzip     *gzip.Writer
+	tar      *tar.Writer
+	modTime  time.Time // Modification time of every entry: the start of the run
+	flush    bool      // Pad each entry as soon as it is written, for measuring
+}
 
-	// If the pattern is from the root directory (empty dir), it applies to all files
-	if patternDir == "" {
-		return matchPattern(filePath, patternText)
+func (f *tarFormatter) Extension() string {
+	if f.compress {
+		return "tar.gz"
 	}
+	return "tar"
+}
 
-	// Check if the file path is within the directory where this pattern was defined
-	// or in a subdirectory of that directory
-	if !strings.HasPrefix(filePath, patternDir+"/") && filePath != patternDir {
-		return false
-	}
+func (*tarFormatter) Description() string { return "" }
 
-	// For patterns defined in a subdirectory, we need to check if the pattern
-	// matches the relative path from that directory
-	if patternDir != "" {
-		// Get the relative path from the pattern's directory
-		relPath := filePath
-		if strings.HasPrefix(filePath, patternDir+"/") {
-			relPath = filePath[len(patternDir+"/"):]
-		}
-		return matchPattern(relPath, patternText)
+func (f *tarFormatter) WriteHeader(w io.Writer, description string) error {
+	// The formatter is reused by --watch, so every archive starts afresh
+	f.gzip = nil
+	if f.compress {
+		f.gzip = gzip.NewWriter(w)
+		w = f.gzip
 	}
+	f.tar = tar.NewWriter(w)
+	f.modTime = time.Now().Truncate(time.Second)
+	return nil
+}
+
+func (*tarFormatter) WriteManifest(w io.Writer, files []FileEntry) error { return nil }
 
-	return matchPattern(filePath, patternText)
+func (f *tarFormatter) WriteFile(w io.Writer, relPath string, content []byte) error {
+	return f.writeEntry(&tar.Header{Typeflag: tar.TypeReg, Name: relPath, Mode: 0644, Size: int64(len(content))}, content)
 }
 
-// Enhanced pattern matching for gitignore patterns
-func matchPattern(filePath, pattern string) bool {
-	// Remove leading slash
-	pattern = strings.TrimPrefix(pattern, "/")
-	filePath = strings.TrimPrefix(filePath, "/")
+// WriteBinary stores binaries as they are, since an archive needs no encoding
+func (f *tarFormatter) WriteBinary(w io.Writer, relPath string, content []byte) error {
+	return f.WriteFile(w, relPath, content)
+}
 
-	// Convert to forward slashes for consistent matching
-	filePath = filepath.ToSlash(filePath)
-	pattern = filepath.ToSlash(pattern)
+// WriteDuplicate stores a --dedup copy as a hard link to the first file
+func (f *tarFormatter) WriteDuplicate(w io.Writer, relPath, originalPath string) error {
+	return f.writeEntry(&tar.Header{Typeflag: tar.TypeLink, Name: relPath, Linkname: originalPath, Mode: 0644}, nil)
+}
 
-	// Handle negation (patterns starting with !)
-	if strings.HasPrefix(pattern, "!") {
-		return false // Negation not supported in this context
-	}
+// WriteRemoved writes nothing, as an archive cannot record a removed file
+func (*tarFormatter) WriteRemoved(w io.Writer, relPath string) error { return nil }
 
-	// Handle double asterisk patterns (/**/)
-	if strings.Contains(pattern, "/**/") {
-		return matchDoubleAsterisk(filePath, pattern)
+func (f *tarFormatter) WriteEmptyDir(w io.Writer, relPath string) error {
+	return f.writeEntry(&tar.Header{Typeflag: tar.TypeDir, Name: relPath, Mode: 0755}, nil)
+}
+
+func (f *tarFormatter) WriteSymlink(w io.Writer, relPath, target string) error {
+	return f.writeEntry(&tar.Header{Typeflag: tar.TypeSymlink, Name: relPath, Linkname: target, Mode: 0777}, nil)
+}
+
+func (*tarFormatter) WriteGroup(w io.Writer, dir string) error { return nil }
+
+// WriteEnd finishes the archive and the compression, leaving the output open
+func (f *tarFormatter) WriteEnd(w io.Writer) error {
+	if err := f.tar.Close(); err != nil {
+		return err
+	}
+	if f.gzip != nil {
+		return f.gzip.Close()
 	}
+	return nil
+}
+
+// Scratch starts an uncompressed archive on w, whose entries are padded as they
+// are written so the padding is counted. Compression only makes the archive smaller.
+func (f *tarFormatter) Scratch(w io.Writer) Formatter {
+	return &tarFormatter{tar: tar.NewWriter(w), modTime: f.modTime, flush: true}
+}
 
-	// Handle patterns ending with /**
-	if strings.HasSuffix(pattern, "/**") {
-		basePattern := strings.TrimSuffix(pattern, "/**")
-		return strings.HasPrefix(filePath, basePattern+"/") || filePath == basePattern
+// writeEntry writes one archive entry with its content
+func (f *tarFormatter) writeEntry(header *tar.Header, content []byte) error {
+	header.Name = filepath.ToSlash(header.Name)
+	header.ModTime = f.modTime
+	if err := f.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := f.tar.Write(content); err != nil {
+		return err
+	}
+	if f.flush {
+		return f.tar.Flush()
 	}
+	return nil
+}
+
+// xmlFormatter writes a <repository> document with one <file> element per file
+type xmlFormatter struct{}
+
+func (xmlFormatter) Extension() string { return "xml" }
 
-	// Handle patterns starting with **/
-	if strings.HasPrefix(pattern, "**/") {
-		basePattern := strings.TrimPrefix(pattern, "**/")
-		return strings.HasSuffix(filePath, "/"+basePattern) || filePath == basePattern
+func (xmlFormatter) Description() string { return xmlHeader }
+
+func (xmlFormatter) WriteHeader(w io.Writer, description string) error {
+	fmt.Fprintln(w, `<?xml version="1.0" encoding="UTF-8"?>`)
+	_, err := fmt.Fprintln(w, "<repository>")
+	if description == "" {
+		return err
+	}
+	fmt.Fprint(w, "<description>")
+	if err := xml.EscapeText(w, []byte(description)); err != nil {
+		return err
 	}
+	_, err = fmt.Fprintln(w, "</description>")
+	return err
+}
 
-	// Exact match
-	if pattern == filePath {
-		return true
+func (xmlFormatter) WriteManifest(w io.Writer, files []FileEntry) error {
+	fmt.Fprintln(w, "<manifest>")
+	for _, file := range files {
+		fmt.Fprint(w, `<entry path="`)
+		if err := xml.EscapeText(w, []byte(file.RelPath)); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "\" lines=\"%d\" bytes=\"%d\"/>\n", file.Lines, file.Size)
 	}
+	_, err := fmt.Fprintln(w, "</manifest>")
+	return err
+}
 
-	// Directory pattern (ends with /)
-	if strings.HasSuffix(pattern, "/") {
-		dirPattern := strings.TrimSuffix(pattern, "/")
-		return strings.HasPrefix(filePath, dirPattern+"/") || filePath == dirPattern
+func (f xmlFormatter) WriteFile(w io.Writer, relPath string, content []byte) error {
+	// CDATA cannot hold characters XML forbids, such as the ESC of ANSI color codes
+	if !isXMLText(content) {
+		return f.WriteBinary(w, relPath, content)
 	}
 
-	// Enhanced wildcard patterns
-	if strings.Contains(pattern, "*") || strings.Contains(pattern, "?") || strings.Contains(pattern, "[") {
-		return enhancedWildcardMatch(filePath, pattern)
+	// EscapeText also escapes quotes, so the result is safe inside an attribute
+	fmt.Fprint(w, `<file path="`)
+	if err := xml.EscapeText(w, []byte(relPath)); err != nil {
+		return err
 	}
+	fmt.Fprint(w, `"><![CDATA[`)
+
+	// A CDATA section cannot contain "]]>", so split it across two sections
+	escaped := strings.ReplaceAll(string(content), "]]>", "]]]]><![CDATA[>")
+	fmt.Fprint(w, escaped)
 
-	// Prefix match for directories
-	return strings.HasPrefix(filePath, pattern+"/")
+	_, err := fmt.Fprintln(w, "]]></file>")
+	return err
 }
 
-// matchDoubleAsterisk handles /**/ patterns
-func matchDoubleAsterisk(filePath, pattern string) bool {
-	parts := strings.Split(pattern, "/**/")
-	if len(parts) != 2 {
-		return false
+// isXMLText reports whether content is UTF-8 made only of characters allowed in an
+// XML 1.0 document: tab, newline, carriage return and everything from space up,
+// except surrogates and U+FFFE and U+FFFF
+func isXMLText(content []byte) bool {
+	for len(content) > 0 {
+		r, size := utf8.DecodeRune(content)
+		if r == utf8.RuneError && size <= 1 {
+			return false
+		}
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r >= 0xD800 && r <= 0xDFFF || r == 0xFFFE || r == 0xFFFF {
+			return false
+		}
+		content = content[size:]
 	}
+	return true
+}
 
-	prefix := parts[0]
-	suffix := parts[1]
-
-	// If prefix is empty, just check suffix
-	if prefix == "" {
-		return strings.HasSuffix(filePath, "/"+suffix) || filePath == suffix
+func (xmlFormatter) WriteBinary(w io.Writer, relPath string, content []byte) error {
+	fmt.Fprint(w, `<file path="`)
+	if err := xml.EscapeText(w, []byte(relPath)); err != nil {
+		return err
 	}
-
-	// If suffix is empty, just check prefix
-	if suffix == "" {
-		return strings.HasPrefix(filePath, prefix+"/") || filePath == prefix
+	fmt.Fprintln(w, `" encoding="base64">`)
+	if err := writeBase64Lines(w, content); err != nil {
+		return err
 	}
+	_, err := fmt.Fprintln(w, "</file>")
+	return err
+}
 
-	// Check both prefix and suffix
-	if !strings.HasPrefix(filePath, prefix) {
-		return false
+func (xmlFormatter) WriteDuplicate(w io.Writer, relPath, originalPath string) error {
+	fmt.Fprint(w, `<file path="`)
+	if err := xml.EscapeText(w, []byte(relPath)); err != nil {
+		return err
 	}
-
-	// Find suffix after prefix
-	remaining := filePath[len(prefix):]
-	return strings.HasSuffix(remaining, "/"+suffix) || remaining == "/"+suffix
+	fmt.Fprint(w, `" identical-to="`)
+	if err := xml.EscapeText(w, []byte(originalPath)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w, `"/>`)
+	return err
 }
 
-// enhancedWildcardMatch handles *, ?, and character classes
-func enhancedWildcardMatch(text, pattern string) bool {
-	// Convert pattern to regex-like matching
-	return matchWildcardPattern(text, pattern)
+func (xmlFormatter) WriteRemoved(w io.Writer, relPath string) error {
+	fmt.Fprint(w, `<file path="`)
+	if err := xml.EscapeText(w, []byte(relPath)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w, `" removed="true"/>`)
+	return err
 }
 
-// matchWildcardPattern implements enhanced wildcard matching
-func matchWildcardPattern(text, pattern string) bool {
-	// Handle simple cases first
-	if pattern == "*" {
-		return true
-	}
-	if pattern == "?" {
-		return len(text) == 1
+// WriteEmptyDir writes an empty directory element, so it is not mistaken for a file
+func (xmlFormatter) WriteEmptyDir(w io.Writer, relPath string) error {
+	fmt.Fprint(w, `<directory path="`)
+	if err := xml.EscapeText(w, []byte(relPath)); err != nil {
+		return err
 	}
-
-	// Convert pattern to regex-like matching
-	return matchPatternRecursive(text, pattern)
+	_, err := fmt.Fprintln(w, `" empty="true"/>`)
+	return err
 }
 
-// matchPatternRecursive recursively matches pattern against text
-func matchPatternRecursive(text, pattern string) bool {
-	// Base cases
-	if pattern == "" {
-		return text == ""
+func (xmlFormatter) WriteSymlink(w io.Writer, relPath, target string) error {
+	fmt.Fprint(w, `<symlink path="`)
+	if err := xml.EscapeText(w, []byte(relPath)); err != nil {
+		return err
 	}
-	if text == "" {
-		return pattern == "" || pattern == "*"
+	fmt.Fprint(w, `" target="`)
+	if err := xml.EscapeText(w, []byte(target)); err != nil {
+		return err
 	}
+	_, err := fmt.Fprintln(w, `"/>`)
+	return err
+}
 
-	// Handle different pattern characters
-	switch pattern[0] {
-	case '*':
-		// * can match zero or more characters
-		if len(pattern) == 1 {
-			return true // * at end matches everything
-		}
-		// Try matching * with 0, 1, 2, ... characters
-		for i := 0; i <= len(text); i++ {
-			if matchPatternRecursive(text[i:], pattern[1:]) {
-				return true
-			}
-		}
-		return false
+// WriteGroup writes nothing, as each path attribute already names its directory
+func (xmlFormatter) WriteGroup(w io.Writer, dir string) error { return nil }
 
-	case '?':
-		// ? matches exactly one character
-		return matchPatternRecursive(text[1:], pattern[1:])
+func (xmlFormatter) WriteEnd(w io.Writer) error {
+	_, err := fmt.Fprintln(w, "</repository>")
+	return err
+}
 
-	case '[':
-		// Character class
-		end := strings.Index(pattern, "]")
-		if end == -1 {
-			return false // Malformed character class
-		}
-		charClass := pattern[1:end]
-		remainingPattern := pattern[end+1:]
+// languageByExtension maps file extensions to language names used for code highlighting hints
+var languageByExtension = map[string]string{
+	".c":     "c",
+	".cc":    "cpp",
+	".cpp":   "cpp",
+	".cs":    "csharp",
+	".css":   "css",
+	".go":    "go",
+	".h":     "c",
+	".hpp":   "cpp",
+	".html":  "html",
+	".java":  "java",
+	".js":    "javascript",
+	".json":  "json",
+	".jsx":   "javascript",
+	".kt":    "kotlin",
+	".lua":   "lua",
+	".md":    "markdown",
+	".php":   "php",
+	".pl":    "perl",
+	".py":    "python",
+	".rb":    "ruby",
+	".rs":    "rust",
+	".scala": "scala",
+	".sh":    "bash",
+	".sql":   "sql",
+	".swift": "swift",
+	".toml":  "toml",
+	".ts":    "typescript",
+	".tsx":   "typescript",
+	".xml":   "xml",
+	".yaml":  "yaml",
+	".yml":   "yaml",
+}
 
-		// Check if current character matches the class
-		if len(text) == 0 {
-			return false
-		}
-		if !matchCharacterClass(text[0], charClass) {
-			return false
-		}
-		return matchPatternRecursive(text[1:], remainingPattern)
+// languageByFilename maps well-known file names that the extension doesn't identify
+var languageByFilename = map[string]string{
+	"CMakeLists.txt": "cmake",
+	"Dockerfile":     "dockerfile",
+	"GNUmakefile":    "makefile",
+	"Gemfile":        "ruby",
+	"Jenkinsfile":    "groovy",
+	"Makefile":       "makefile",
+	"Rakefile":       "ruby",
+	"Vagrantfile":    "ruby",
+	"makefile":       "makefile",
+}
 
-	default:
-		// Literal character
-		if text[0] != pattern[0] {
-			return false
-		}
-		return matchPatternRecursive(text[1:], pattern[1:])
-	}
+// languageByInterpreter maps #! interpreters to language names
+var languageByInterpreter = map[string]string{
+	"bash":    "bash",
+	"node":    "javascript",
+	"perl":    "perl",
+	"php":     "php",
+	"python":  "python",
+	"python3": "python",
+	"ruby":    "ruby",
+	"sh":      "bash",
+	"zsh":     "bash",
 }
 
-// matchCharacterClass checks if a character matches a character class
-func matchCharacterClass(c byte, charClass string) bool {
-	if len(charClass) == 0 {
-		return false
+// detectLanguage returns the language name for a file, or "" if unknown. Well-known
+// file names such as Dockerfile come first, then the extension, then the
+// interpreter of a #! line at the start of content.
+func detectLanguage(relPath string, content []byte) string {
+	name := filepath.Base(relPath)
+	if language, ok := languageByFilename[name]; ok {
+		return language
 	}
-
-	// Handle negation
-	negated := false
-	if charClass[0] == '!' {
-		negated = true
-		charClass = charClass[1:]
+	// Variants such as Dockerfile.dev
+	if strings.HasPrefix(name, "Dockerfile.") {
+		return "dockerfile"
 	}
+	if language, ok := languageByExtension[strings.ToLower(filepath.Ext(relPath))]; ok {
+		return language
+	}
+	return languageFromShebang(content)
+}
 
-	// Handle ranges like a-z
-	for i := 0; i < len(charClass); i++ {
-		if i+2 < len(charClass) && charClass[i+1] == '-' {
-			start := charClass[i]
-			end := charClass[i+2]
-			if c >= start && c <= end {
-				return !negated
-			}
-			i += 2 // Skip the range
-		} else {
-			if c == charClass[i] {
-				return !negated
-			}
+// languageFromShebang returns the language of the interpreter named on a leading
+// #! line, looking through /usr/bin/env and its options
+func languageFromShebang(content []byte) string {
+	if !bytes.HasPrefix(content, []byte("#!")) {
+		return ""
+	}
+	line, _, _ := bytes.Cut(content[2:], []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) > 0 && path.Base(fields[0]) == "env" {
+		fields = fields[1:]
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "-") {
+			fields = fields[1:]
 		}
 	}
-
-	return negated
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := path.Base(fields[0])
+	if language, ok := languageByInterpreter[interpreter]; ok {
+		return language
+	}
+	// Versioned names such as python3.12
+	return languageByInterpreter[strings.TrimRight(interpreter, "0123456789.")]
 }
 
-func isBinary(path string) bool {
+// loadLanguageMap reads "EXT LANGUAGE" lines into languageByExtension
+func loadLanguageMap(path string) error {
 	file, err := os.Open(path)
 	if err != nil {
-		// Check if it's a permission error
-		if os.IsPermission(err) {
-			printWarning("Permission denied reading %s: %v", path, err)
-			return true // Assume binary if can't read due to permissions
-		}
-		return true // Assume binary if can't read
+		return err
 	}
 	defer file.Close()
 
-	// Read first 512 bytes
-	buffer := make([]byte, 512)
-	n, err := file.Read(buffer)
-	if err != nil && n == 0 {
-		return true
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		fields := strings.Fields(scanner.Text())
+		// Skip empty lines and comments
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected an extension and a language", lineNumber)
+		}
+		ext := strings.ToLower(fields[0])
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		languageByExtension[ext] = fields[1]
 	}
+	return scanner.Err()
+}
 
-	// Check for null bytes
-	for i := 0; i < n; i++ {
-		if buffer[i] == 0 {
-			return true
-		}
+// printLanguages prints the extension to language table sorted by extension
+func printLanguages() {
+	extensions := make([]string, 0, len(languageByExtension))
+	for ext := range languageByExtension {
+		extensions = append(extensions, ext)
 	}
+	sort.Strings(extensions)
 
-	return false
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "EXTENSION\tLANGUAGE")
+	for _, ext := range extensions {
+		fmt.Fprintf(tw, "%s\t%s\n", ext, languageByExtension[ext])
+	}
+	tw.Flush()
 }
 
-func processFile(path, relPath string, output *os.File) error {
-	content, err := os.ReadFile(path)
-	if err != nil {
-		// Check if it's a permission error
-		if os.IsPermission(err) {
-			printWarning("Permission denied reading %s: %v", path, err)
-			return nil // Skip this file, continue processing
-		}
-		return err
-	}
+// htmlStyle and htmlScript are inlined so the HTML output is a single self-contained page
+const htmlStyle = `body{margin:0;font:14px/1.5 system-ui,sans-serif;display:flex}
+nav{position:sticky;top:0;height:100vh;overflow:auto;width:280px;flex:none;padding:12px;box-sizing:border-box;background:#f6f8fa;border-right:1px solid #d0d7de}
+nav details{margin-left:12px}nav summary{cursor:pointer}nav a{display:block;margin-left:12px;color:#0969da;text-decoration:none;white-space:nowrap}
+main{flex:1;min-width:0;padding:0 24px}section{margin:24px 0}h2{font-size:15px;font-family:monospace;border-bottom:1px solid #d0d7de}
+pre{background:#f6f8fa;padding:12px;overflow:auto}code{font:13px/1.45 ui-monospace,monospace}
+table{border-collapse:collapse}td,th{padding:2px 12px;text-align:right;font-family:monospace}td:last-child{text-align:left}`
+
+const htmlScript = `(function(){
+var nav=document.getElementById("tree"),root={dirs:{},files:[]};
+document.querySelectorAll("main section[data-path]").forEach(function(s){
+var parts=s.dataset.path.split("/"),node=root;
+for(var i=0;i<parts.length-1;i++){node=node.dirs[parts[i]]=node.dirs[parts[i]]||{dirs:{},files:[]};}
+node.files.push({name:parts[parts.length-1],id:s.id});});
+function render(node,parent){
+Object.keys(node.dirs).sort().forEach(function(name){
+var d=document.createElement("details"),sum=document.createElement("summary");
+d.open=true;sum.textContent=name+"/";d.appendChild(sum);render(node.dirs[name],d);parent.appendChild(d);});
+node.files.forEach(function(f){var a=document.createElement("a");a.href="#"+encodeURIComponent(f.id);a.textContent=f.name;parent.appendChild(a);});}
+render(root,nav);})();`
 
-	// Write section separator
-	fmt.Fprintln(output, SectionDivider)
+// highlight.js assets loaded by --highlight
+const (
+	highlightStylesheet = "https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.9.0/styles/github.min.css"
+	highlightScript     = "https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.9.0/highlight.min.js"
+)
 
-	// Write file path
-	fmt.Fprintln(output, relPath)
+// htmlFormatter writes a self-contained HTML page with a file tree sidebar
+type htmlFormatter struct {
+	highlight bool // Load highlight.js, which makes the page depend on the network
+}
 
-	// Write file contents
-	fmt.Fprint(output, string(content))
+func (htmlFormatter) Extension() string { return "html" }
 
-	// Ensure newline after content
-	if len(content) > 0 && content[len(content)-1] != '\n' {
-		fmt.Fprintln(output)
+// htmlID returns the anchor id of a file section
+func htmlID(relPath string) string {
+	return "file-" + filepath.ToSlash(relPath)
+}
+
+func (htmlFormatter) Description() string { return htmlHeader }
+
+func (f htmlFormatter) WriteHeader(w io.Writer, description string) error {
+	stylesheet := ""
+	if f.highlight {
+		stylesheet = fmt.Sprintf("<link rel=\"stylesheet\" href=\"%s\">\n", highlightStylesheet)
+	}
+	if description != "" {
+		description = fmt.Sprintf("<p>%s</p>\n", html.EscapeString(description))
 	}
+	_, err := fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Repository contents</title>
+%s<style>
+%s
+</style>
+</head>
+<body>
+<nav id="tree"></nav>
+<main>
+%s`, stylesheet, htmlStyle, description)
+	return err
+}
 
-	return nil
+func (htmlFormatter) WriteManifest(w io.Writer, files []FileEntry) error {
+	fmt.Fprintln(w, "<table>\n<tr><th>Lines</th><th>Bytes</th><th>Path</th></tr>")
+	for _, file := range files {
+		fmt.Fprintf(w, "<tr><td>%d</td><td>%d</td><td><a href=\"#%s\">%s</a></td></tr>\n",
+			file.Lines, file.Size, html.EscapeString(url.PathEscape(htmlID(file.RelPath))), html.EscapeString(file.RelPath))
+	}
+	_, err := fmt.Fprintln(w, "</table>")
+	return err
 }
 
-func writeEnd(outputPath string) error {
-	file, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		// Check if it's a permission error
-		if os.IsPermission(err) {
-			printWarning("Permission denied writing to %s: %v", outputPath, err)
-			return err // This is a critical error, return it
-		}
-		return err
+func (htmlFormatter) WriteFile(w io.Writer, relPath string, content []byte) error {
+	class := ""
+	if language := detectLanguage(relPath, content); language != "" {
+		class = fmt.Sprintf(` class="language-%s"`, language)
 	}
-	defer file.Close()
+	_, err := fmt.Fprintf(w, "<section id=\"%s\" data-path=\"%s\">\n<h2>%s</h2>\n<pre><code%s>%s</code></pre>\n</section>\n",
+		html.EscapeString(htmlID(relPath)), html.EscapeString(filepath.ToSlash(relPath)), html.EscapeString(relPath), class, html.EscapeString(string(content)))
+	return err
+}
+
+func (htmlFormatter) WriteBinary(w io.Writer, relPath string, content []byte) error {
+	var encoded strings.Builder
+	writeBase64Lines(&encoded, content)
+	_, err := fmt.Fprintf(w, "<section id=\"%s\" data-path=\"%s\" data-encoding=\"base64\">\n<h2>%s</h2>\n<p>Binary file, base64-encoded</p>\n<pre>%s</pre>\n</section>\n",
+		html.EscapeString(htmlID(relPath)), html.EscapeString(filepath.ToSlash(relPath)), html.EscapeString(relPath), encoded.String())
+	return err
+}
 
-	_, err = fmt.Fprintln(file, EndMarker)
+func (htmlFormatter) WriteDuplicate(w io.Writer, relPath, originalPath string) error {
+	_, err := fmt.Fprintf(w, "<section id=\"%s\" data-path=\"%s\">\n<h2>%s</h2>\n<p>Identical to <a href=\"#%s\">%s</a></p>\n</section>\n",
+		html.EscapeString(htmlID(relPath)), html.EscapeString(filepath.ToSlash(relPath)), html.EscapeString(relPath),
+		html.EscapeString(url.PathEscape(htmlID(originalPath))), html.EscapeString(originalPath))
+	return err
+}
+
+func (htmlFormatter) WriteRemoved(w io.Writer, relPath string) error {
+	_, err := fmt.Fprintf(w, "<section id=\"%s\" data-path=\"%s\">\n<h2>%s</h2>\n<p>Removed</p>\n</section>\n",
+		html.EscapeString(htmlID(relPath)), html.EscapeString(filepath.ToSlash(relPath)), html.EscapeString(relPath))
+	return err
+}
+
+// WriteEmptyDir writes a section without data-path, so the directory stays out of the file tree
+func (htmlFormatter) WriteEmptyDir(w io.Writer, relPath string) error {
+	_, err := fmt.Fprintf(w, "<section id=\"%s\">\n<h2>%s</h2>\n<p>Empty directory</p>\n</section>\n",
+		html.EscapeString(htmlID(relPath)), html.EscapeString(relPath))
+	return err
+}
+
+// WriteSymlink writes a section without data-path, since there is no content to show
+func (htmlFormatter) WriteSymlink(w io.Writer, relPath, target string) error {
+	_, err := fmt.Fprintf(w, "<section id=\"%s\">\n<h2>%s</h2>\n<p>Symbolic link to <code>%s</code></p>\n</section>\n",
+		html.EscapeString(htmlID(relPath)), html.EscapeString(relPath), html.EscapeString(target))
+	return err
+}
+
+func (htmlFormatter) WriteGroup(w io.Writer, dir string) error {
+	_, err := fmt.Fprintf(w, "<h1>%s/</h1>\n", html.EscapeString(dir))
+	return err
+}
+
+func (f htmlFormatter) WriteEnd(w io.Writer) error {
+	fmt.Fprintf(w, "</main>\n<script>\n%s\n</script>\n", htmlScript)
+	if f.highlight {
+		fmt.Fprintf(w, "<script src=\"%s\"></script>\n<script>hljs.highlightAll();</script>\n", highlightScript)
+	}
+	_, err := fmt.Fprintln(w, "</body>\n</html>")
 	return err
 }